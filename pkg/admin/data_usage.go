@@ -0,0 +1,36 @@
+// Package admin exposes HTTP endpoints used by operators to inspect and
+// manage a running Pyroscope server, as opposed to the ingestion and
+// query endpoints used by agents and the UI.
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+)
+
+// DataUsageHandler serves the cached storage.DataUsageInfo summary so
+// operators can see which applications dominate disk usage before
+// tuning retention settings.
+type DataUsageHandler struct {
+	log     *logrus.Logger
+	storage *storage.Storage
+}
+
+func NewDataUsageHandler(log *logrus.Logger, s *storage.Storage) *DataUsageHandler {
+	return &DataUsageHandler{log: log, storage: s}
+}
+
+func (h *DataUsageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.storage.DataUsageInfo()); err != nil {
+		h.log.WithError(err).Error("failed to write data usage response")
+	}
+}
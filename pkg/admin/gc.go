@@ -0,0 +1,62 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+)
+
+// GCHandler serves POST /admin/gc?app=myapp&maxAge=24h, letting an
+// operator reclaim disk space for one application without waiting for
+// the regular maintenance schedule or affecting any other application's
+// data.
+type GCHandler struct {
+	log     *logrus.Logger
+	storage *storage.Storage
+}
+
+func NewGCHandler(log *logrus.Logger, s *storage.Storage) *GCHandler {
+	return &GCHandler{log: log, storage: s}
+}
+
+func (h *GCHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sel := storage.Selector{AppName: r.URL.Query().Get("app")}
+	if s := r.URL.Query().Get("maxAge"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			http.Error(w, "invalid maxAge: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		sel.MaxAge = d
+	}
+
+	removed, err := h.storage.CollectGarbageFor(sel)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotMaintenanceLeader) {
+			// Let the operator retry against whichever node is
+			// currently leading maintenance instead of silently racing
+			// a concurrent GC or compaction pass there.
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(struct {
+		BytesRemoved uint64 `json:"bytesRemoved"`
+	}{uint64(removed)}); err != nil {
+		h.log.WithError(err).Error("failed to write gc response")
+	}
+}
@@ -0,0 +1,54 @@
+// Package cli holds operator-facing subcommands that talk to a
+// Storage directly, for maintenance tasks that don't warrant going
+// through the HTTP admin API (e.g. when run against a stopped server's
+// StoragePath before a migration).
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+)
+
+// newGCCommand returns the "gc" subcommand, which applies a
+// storage.Selector-scoped cleanup to c.StoragePath, the same cleanup
+// the /admin/gc endpoint performs against a running server.
+func newGCCommand(c *config.Server, log *logrus.Logger) *cobra.Command {
+	var app, maxAge string
+	cmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Reclaim disk space for a subset of stored profiling data",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			sel := storage.Selector{AppName: app}
+			if maxAge != "" {
+				d, err := time.ParseDuration(maxAge)
+				if err != nil {
+					return fmt.Errorf("invalid --max-age: %w", err)
+				}
+				sel.MaxAge = d
+			}
+
+			s, err := storage.New(c, log, nil)
+			if err != nil {
+				return fmt.Errorf("opening storage: %w", err)
+			}
+			defer s.Close()
+
+			removed, err := s.CollectGarbageFor(sel)
+			if err != nil {
+				return err
+			}
+			cmd.Printf("reclaimed %s\n", removed)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&app, "app", "", "application name to restrict the gc pass to (required)")
+	cmd.Flags().StringVar(&maxAge, "max-age", "", "only remove data older than this (e.g. 24h)")
+	_ = cmd.MarkFlagRequired("app")
+	return cmd
+}
@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// kind identifies which of the four datasets merged into a Head a given
+// key/value pair belongs to, so that a single block directory can hold
+// all of them without colliding keys.
+type kind uint8
+
+const (
+	kindSegment kind = iota
+	kindDimension
+	kindTree
+	kindDict
+)
+
+// blockFile returns the file within a block directory that a kind is
+// persisted to. Segments and dimensions share the index file, since
+// together they form the searchable index over the block's series.
+func (k kind) blockFile() string {
+	switch k {
+	case kindSegment, kindDimension:
+		return "index"
+	case kindTree:
+		return "trees"
+	case kindDict:
+		return "dicts"
+	default:
+		panic("storage: unknown kind")
+	}
+}
+
+// taggedKey prefixes key with k's one-byte tag. The index file holds
+// both segment and dimension entries, so the tag disambiguates them;
+// every block entry carries it for consistency even where it is
+// redundant (trees, dicts).
+func taggedKey(k kind, key []byte) []byte {
+	b := make([]byte, 1+len(key))
+	b[0] = byte(k)
+	copy(b[1:], key)
+	return b
+}
+
+// untagKey splits a key written by taggedKey back into its kind and
+// the original key bytes.
+func untagKey(b []byte) (kind, []byte) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return kind(b[0]), b[1:]
+}
+
+// blockMeta describes a single immutable block directory, mirroring the
+// role of meta.json in Prometheus TSDB blocks.
+type blockMeta struct {
+	ULID    ulid.ULID `json:"ulid"`
+	MinTime time.Time `json:"minTime"`
+	MaxTime time.Time `json:"maxTime"`
+
+	// Level is the compaction level: 0 for blocks flushed directly from
+	// a Head, N for blocks produced by merging two or more level N-1
+	// blocks.
+	Level int `json:"level"`
+
+	Stats blockStats `json:"stats"`
+
+	// dir is the absolute path of the block directory; it is not
+	// serialized, and is populated when the meta is read off disk.
+	dir string
+}
+
+type blockStats struct {
+	NumSegments   int `json:"numSegments"`
+	NumDimensions int `json:"numDimensions"`
+	NumTrees      int `json:"numTrees"`
+	NumDicts      int `json:"numDicts"`
+}
+
+func (m *blockMeta) path() string { return m.dir }
+
+func readMeta(dir string) (*blockMeta, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "meta.json"))
+	if err != nil {
+		return nil, err
+	}
+	var m blockMeta
+	if err = json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("storage: unmarshal %s: %w", dir, err)
+	}
+	m.dir = dir
+	return &m, nil
+}
+
+func writeMeta(dir string, m *blockMeta) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "meta.json"), b, 0o644)
+}
+
+// listBlocks reads every block directory under blocksDir and returns
+// their metadata sorted by MinTime, oldest first.
+func listBlocks(blocksDir string) ([]*blockMeta, error) {
+	entries, err := ioutil.ReadDir(blocksDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	metas := make([]*blockMeta, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		m, err := readMeta(filepath.Join(blocksDir, e.Name()))
+		if err != nil {
+			// A directory without a readable meta.json is either still
+			// being written or was left behind by a crash; skip it. It is
+			// left on disk as it is.
+			continue
+		}
+		metas = append(metas, m)
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].MinTime.Before(metas[j].MinTime) })
+	return metas, nil
+}
+
+// blockEntry is a single key/value record inside one of a block's data
+// files (index, trees, dicts).
+type blockEntry struct {
+	Key   []byte
+	Value []byte
+}
+
+// writeBlockFile writes entries, which must already be sorted by Key, to
+// path as a flat, appendable sequence of framed records:
+//
+//	len(key) uint32 | len(value) uint32 | key | value | crc32 uint32
+func writeBlockFile(path string, entries []blockEntry) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, e := range entries {
+		if err = writeBlockEntry(w, e); err != nil {
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// writeBlockFileAtomic rewrites an existing block file's entries via a
+// temp-file-and-rename, instead of writeBlockFile's O_TRUNC, so that a
+// concurrent reader going through the path directly (os.Open) never
+// observes a torn, partially-rewritten file: os.Rename swaps the
+// directory entry in one step, and any reader that already opened the
+// old file keeps reading its old (complete) contents until it closes
+// it. Used by deleteMatchingInBlock, which rewrites a block already
+// serving reads, unlike flush/compaction, which only ever write into a
+// brand-new block directory nothing has read yet.
+func writeBlockFileAtomic(path string, entries []blockEntry) error {
+	tmp := path + ".tmp"
+	if err := writeBlockFile(tmp, entries); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func writeBlockEntry(w io.Writer, e blockEntry) error {
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(len(e.Key)))
+	binary.BigEndian.PutUint32(hdr[4:8], uint32(len(e.Value)))
+	crc := crc32.NewIEEE()
+	_, _ = crc.Write(hdr)
+	_, _ = crc.Write(e.Key)
+	_, _ = crc.Write(e.Value)
+	for _, b := range [][]byte{hdr, e.Key, e.Value} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	var crcBuf [4]byte
+	binary.BigEndian.PutUint32(crcBuf[:], crc.Sum32())
+	_, err := w.Write(crcBuf[:])
+	return err
+}
+
+// readBlockFile reads every entry out of a file written by
+// writeBlockFile. Entries come back in the order they were written,
+// i.e. sorted by Key.
+func readBlockFile(path string) ([]blockEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decodeBlockEntries(bufio.NewReader(f))
+}
+
+// decodeBlockEntries reads every framed record out of r, in the format
+// written by writeBlockEntry, until it runs out of input. It is shared
+// by readBlockFile and the filecache-backed read path in blockstore.go,
+// which decodes from an in-memory buffer rather than a file directly.
+func decodeBlockEntries(r io.Reader) ([]blockEntry, error) {
+	var entries []blockEntry
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return entries, nil // EOF, or a torn trailing record; stop reading
+		}
+		keyLen := binary.BigEndian.Uint32(hdr[0:4])
+		valLen := binary.BigEndian.Uint32(hdr[4:8])
+		body := make([]byte, keyLen+valLen+4)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return entries, nil
+		}
+		payload := body[:keyLen+valLen]
+		crc := binary.BigEndian.Uint32(body[keyLen+valLen:])
+		if crc32.ChecksumIEEE(append(hdr[:], payload...)) != crc {
+			return nil, fmt.Errorf("storage: corrupt block entry: crc mismatch")
+		}
+		entries = append(entries, blockEntry{
+			Key:   body[:keyLen],
+			Value: body[keyLen : keyLen+valLen],
+		})
+	}
+}
+
+// findEntry returns the value for key among entries, which need not be
+// sorted.
+func findEntry(entries []blockEntry, key []byte) ([]byte, bool) {
+	for _, e := range entries {
+		if string(e.Key) == string(key) {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+// findInBlockFile performs a linear scan for key. Block data files are
+// small and read sequentially at most once per lookup miss in the Head;
+// a binary-searchable on-disk format is tracked as a follow-up once
+// block sizes warrant it.
+func findInBlockFile(path string, key []byte) ([]byte, bool, error) {
+	entries, err := readBlockFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	v, ok := findEntry(entries, key)
+	return v, ok, nil
+}
+
+// newBlockID generates a new, time-sortable block identifier.
+func newBlockID(t time.Time) ulid.ULID {
+	return ulid.MustNew(ulid.Timestamp(t), ulidEntropy)
+}
@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteReadBlockFileRoundTrip(t *testing.T) {
+	entries := []blockEntry{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("b"), Value: []byte("2")},
+	}
+	path := filepath.Join(t.TempDir(), "data")
+	if err := writeBlockFile(path, entries); err != nil {
+		t.Fatalf("writeBlockFile: %v", err)
+	}
+
+	got, err := readBlockFile(path)
+	if err != nil {
+		t.Fatalf("readBlockFile: %v", err)
+	}
+	if len(got) != len(entries) {
+		t.Fatalf("got %d entries, want %d", len(got), len(entries))
+	}
+	for i, e := range entries {
+		if string(got[i].Key) != string(e.Key) || string(got[i].Value) != string(e.Value) {
+			t.Errorf("entry %d = %+v, want %+v", i, got[i], e)
+		}
+	}
+}
+
+func TestDecodeBlockEntriesDetectsCorruption(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeBlockEntry(&buf, blockEntry{Key: []byte("a"), Value: []byte("1")}); err != nil {
+		t.Fatalf("writeBlockEntry: %v", err)
+	}
+	corrupt := buf.Bytes()
+	corrupt[len(corrupt)-1] ^= 0xFF // flip a byte inside the trailing CRC
+
+	if _, err := decodeBlockEntries(bytes.NewReader(corrupt)); err == nil {
+		t.Fatal("decodeBlockEntries: expected a crc mismatch error, got nil")
+	}
+}
@@ -0,0 +1,450 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage/filecache"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/segment"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/wal"
+	"github.com/pyroscope-io/pyroscope/pkg/util/bytesize"
+)
+
+// defaultBlockCacheMax bounds how much of the blocks directory the
+// shared filecache is allowed to keep open/cached by default; it is
+// deliberately generous since the cache only holds handles, not copies
+// of the files; the tidier closes handles once their combined size
+// exceeds it.
+const defaultBlockCacheMax = "1GB"
+
+// defaultHeadWindow is how long a Head stays open for writes before it
+// is rotated out and flushed into a block, mirroring the 2h default
+// Prometheus TSDB uses for its head block.
+const defaultHeadWindow = 2 * time.Hour
+
+// blockStore is the storage engine backing the segments, dimensions,
+// trees and dicts datasets: writes go through a WAL into an in-memory
+// Head, and are made durable as self-contained, immutable block
+// directories once the Head's time window closes. It replaces the
+// per-dataset Badger databases those datasets used to live in.
+type blockStore struct {
+	storagePath string
+	logger      logrus.FieldLogger
+
+	headWindow time.Duration
+
+	wal   *wal.WAL
+	files *filecache.Cache
+
+	mu     sync.RWMutex
+	head   *Head
+	blocks []*blockMeta // sorted by MinTime, oldest first
+}
+
+func (s *Storage) newBlockStore() (*blockStore, error) {
+	walDir := filepath.Join(s.config.StoragePath, "wal")
+	w, err := wal.Open(walDir)
+	if err != nil {
+		return nil, fmt.Errorf("storage: open wal: %w", err)
+	}
+
+	blocksDir := filepath.Join(s.config.StoragePath, "blocks")
+	if err = os.MkdirAll(blocksDir, 0o755); err != nil {
+		return nil, err
+	}
+	blocks, err := listBlocks(blocksDir)
+	if err != nil {
+		return nil, err
+	}
+
+	max, err := filecache.ParseByteSizeOrPercent(defaultBlockCacheMax)
+	if err != nil {
+		return nil, err
+	}
+	logger := s.logger.WithField("component", "blockstore")
+	files, err := filecache.Open(filecache.Config{Dir: blocksDir, Max: max, Logger: logger})
+	if err != nil {
+		return nil, err
+	}
+
+	bs := &blockStore{
+		storagePath: s.config.StoragePath,
+		logger:      logger,
+		headWindow:  defaultHeadWindow,
+		wal:         w,
+		files:       files,
+		blocks:      blocks,
+	}
+
+	start := time.Now()
+	if last := bs.lastBlockMaxTime(); !last.IsZero() {
+		start = last
+	}
+	bs.head = newHead(start, bs.headWindow)
+
+	if err = bs.recover(walDir); err != nil {
+		return nil, fmt.Errorf("storage: recover wal: %w", err)
+	}
+
+	return bs, nil
+}
+
+func (bs *blockStore) lastBlockMaxTime() time.Time {
+	if len(bs.blocks) == 0 {
+		return time.Time{}
+	}
+	return bs.blocks[len(bs.blocks)-1].MaxTime
+}
+
+// recover replays every WAL record into the current Head, restoring the
+// state a crash or restart would otherwise have lost.
+func (bs *blockStore) recover(walDir string) error {
+	var n int
+	err := wal.Replay(walDir, func(rec wal.Record) error {
+		k, key, err := decodeWALKey(rec.Key)
+		if err != nil {
+			return err
+		}
+		bs.head.put(k, key, rec.Value)
+		n++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		bs.logger.WithField("records", n).Info("recovered write-ahead log into head")
+	}
+	return nil
+}
+
+// walKey prefixes key with a one-byte kind tag so a single WAL can carry
+// records for all four datasets without ambiguity on replay.
+func walKey(k kind, key string) []byte {
+	b := make([]byte, 1+len(key))
+	b[0] = byte(k)
+	copy(b[1:], key)
+	return b
+}
+
+func decodeWALKey(b []byte) (kind, string, error) {
+	if len(b) < 1 {
+		return 0, "", fmt.Errorf("storage: empty wal key")
+	}
+	return kind(b[0]), string(b[1:]), nil
+}
+
+// Put durably writes value under key for the given dataset, rotating
+// the head into a new block if its time window has elapsed.
+func (bs *blockStore) Put(k kind, key string, value []byte) error {
+	// The WAL write and the map mutation it backs must both complete
+	// under bs.mu, the same lock rotateLocked holds while cutting a new
+	// WAL segment and swapping in a new Head. Releasing bs.mu between
+	// the WAL write and head.put() would let the periodic head-rotation
+	// task's flush snapshot and truncate run in between: the record
+	// would be fsync'd to a segment that gets truncated, and applied
+	// (if at all) to a Head that was never part of the block the
+	// snapshot persisted -- durably logged and then permanently lost.
+	bs.mu.Lock()
+	if err := bs.wal.Log(wal.Record{Key: walKey(k, key), Value: value}); err != nil {
+		bs.mu.Unlock()
+		return err
+	}
+	bs.head.put(k, key, value)
+	old, rotated, err := bs.rotateLocked(time.Now())
+	bs.mu.Unlock()
+	if err != nil || !rotated {
+		return err
+	}
+	return bs.flush(old)
+}
+
+// rotateIfExpired rotates the head into a new block if its time window
+// has elapsed. It is called independently of Put, by the periodic
+// head-rotation task.
+func (bs *blockStore) rotateIfExpired(now time.Time) error {
+	bs.mu.Lock()
+	old, rotated, err := bs.rotateLocked(now)
+	bs.mu.Unlock()
+	if err != nil || !rotated {
+		return err
+	}
+	return bs.flush(old)
+}
+
+// rotateLocked swaps in a new Head if the current one has expired,
+// cutting a new WAL segment to match, and reports the outgoing Head so
+// the caller can flush it. The caller must hold bs.mu on entry and is
+// responsible for releasing it -- rotateLocked deliberately doesn't
+// call flush itself, since flush does its own (potentially slow) I/O
+// and has no need for bs.mu once the swap above is done.
+func (bs *blockStore) rotateLocked(now time.Time) (old *Head, rotated bool, err error) {
+	if !bs.head.expired(now) {
+		return nil, false, nil
+	}
+	old = bs.head
+	// Cut a new WAL segment before swapping in the new Head, so the
+	// outgoing generation's records stay confined to segments the WAL
+	// can truncate once flush persists them into a block, rather than
+	// sharing a segment with whatever the new Head starts writing.
+	if err := bs.wal.Cut(); err != nil {
+		return nil, false, fmt.Errorf("storage: cut wal segment: %w", err)
+	}
+	bs.head = newHead(now, bs.headWindow)
+	return old, true, nil
+}
+
+// flush persists a closed Head as a new block directory and truncates
+// the WAL segments it made durable, since they are no longer needed
+// for recovery.
+func (bs *blockStore) flush(h *Head) error {
+	id := newBlockID(h.minTime)
+	dir := filepath.Join(bs.storagePath, "blocks", id.String())
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	byFile := make(map[string][]blockEntry)
+	for _, k := range []kind{kindSegment, kindDimension, kindTree, kindDict} {
+		file := k.blockFile()
+		for _, e := range h.sortedEntries(k) {
+			byFile[file] = append(byFile[file], blockEntry{Key: taggedKey(k, e.Key), Value: e.Value})
+		}
+	}
+	for file, entries := range byFile {
+		sort.Slice(entries, func(i, j int) bool { return string(entries[i].Key) < string(entries[j].Key) })
+		if err := writeBlockFile(filepath.Join(dir, file), entries); err != nil {
+			return fmt.Errorf("storage: flush %s: %w", file, err)
+		}
+	}
+	m := &blockMeta{
+		ULID:    id,
+		MinTime: h.minTime,
+		MaxTime: h.maxTime,
+		Level:   0,
+		Stats:   h.stats(),
+		dir:     dir,
+	}
+	if err := writeMeta(dir, m); err != nil {
+		return err
+	}
+
+	bs.mu.Lock()
+	bs.blocks = append(bs.blocks, m)
+	bs.mu.Unlock()
+
+	bs.logger.WithFields(logrus.Fields{
+		"block":   id.String(),
+		"minTime": h.minTime,
+		"maxTime": h.maxTime,
+	}).Debug("flushed head into block")
+
+	return bs.wal.Truncate()
+}
+
+// Get looks up key in the given dataset, consulting the open Head first
+// and then on-disk blocks from newest to oldest.
+func (bs *blockStore) Get(k kind, key string) ([]byte, bool, error) {
+	bs.mu.RLock()
+	head := bs.head
+	blocks := bs.blocks
+	bs.mu.RUnlock()
+
+	if v, ok := head.get(k, key); ok {
+		return v, true, nil
+	}
+	tagged := taggedKey(k, []byte(key))
+	for i := len(blocks) - 1; i >= 0; i-- {
+		v, ok, err := bs.findInBlock(filepath.Join(blocks[i].path(), k.blockFile()), tagged)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			return v, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// findInBlock looks up key in a block data file, going through the
+// shared filecache so that a file held open to serve one lookup can
+// serve the next one too, instead of every Get reopening and rescanning
+// it from a cold file descriptor.
+func (bs *blockStore) findInBlock(path string, key []byte) ([]byte, bool, error) {
+	entries, err := bs.readBlockFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	v, ok := findEntry(entries, key)
+	return v, ok, nil
+}
+
+// readBlockFile reads every entry out of a block data file, going
+// through the shared filecache the same way findInBlock does, so that
+// callers which scan whole blocks (e.g. the data-usage scan) reuse the
+// same held-open handles as point lookups instead of reopening every
+// file from cold.
+func (bs *blockStore) readBlockFile(path string) ([]blockEntry, error) {
+	buf, err := bs.files.QuickReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeBlockEntries(bytes.NewReader(buf))
+}
+
+// DiskUsage reports the combined size of the WAL and every block
+// directory on disk.
+func (bs *blockStore) DiskUsage() bytesize.ByteSize {
+	var size int64
+	_ = filepath.Walk(filepath.Join(bs.storagePath, "wal"), sumFileSize(&size))
+	_ = filepath.Walk(filepath.Join(bs.storagePath, "blocks"), sumFileSize(&size))
+	return bytesize.ByteSize(size)
+}
+
+func sumFileSize(total *int64) filepath.WalkFunc {
+	return func(path string, info os.FileInfo, err error) error {
+		if err != nil || info == nil || info.IsDir() {
+			return nil
+		}
+		*total += info.Size()
+		return nil
+	}
+}
+
+// enforceRetention removes whole blocks that fall entirely before the
+// retention policy's absolute cutoff. Finer, per-level enforcement that
+// requires rewriting tree/dict payloads is left to the compactor.
+func (bs *blockStore) enforceRetention(rp *segment.RetentionPolicy) (removed bytesize.ByteSize, err error) {
+	cutoff := rp.LowerTimeBoundary()
+	if cutoff.IsZero() {
+		return 0, nil
+	}
+
+	bs.mu.Lock()
+	kept := bs.blocks[:0]
+	var toRemove []*blockMeta
+	for _, m := range bs.blocks {
+		if m.MaxTime.Before(cutoff) {
+			toRemove = append(toRemove, m)
+			continue
+		}
+		kept = append(kept, m)
+	}
+	bs.blocks = kept
+	bs.mu.Unlock()
+
+	for _, m := range toRemove {
+		sz, szErr := dirSize(m.path())
+		if szErr == nil {
+			removed += bytesize.ByteSize(sz)
+		}
+		if rmErr := os.RemoveAll(m.path()); rmErr != nil {
+			err = rmErr
+			continue
+		}
+		bs.logger.WithField("block", m.ULID.String()).Debug("removed expired block")
+	}
+	return removed, err
+}
+
+// deleteMatching removes every segment, tree and dict entry matching
+// sel from the head and every on-disk block, returning the combined
+// size of what was removed.
+func (bs *blockStore) deleteMatching(sel Selector) (bytesize.ByteSize, error) {
+	bs.mu.RLock()
+	head := bs.head
+	blocks := append([]*blockMeta(nil), bs.blocks...)
+	bs.mu.RUnlock()
+
+	head.deleteMatching(sel)
+
+	var removed bytesize.ByteSize
+	for _, m := range blocks {
+		n, err := bs.deleteMatchingInBlock(m, sel)
+		if err != nil {
+			return removed, fmt.Errorf("storage: gc block %s: %w", m.ULID.String(), err)
+		}
+		removed += n
+	}
+	return removed, nil
+}
+
+// deleteMatchingInBlock rewrites m's index, trees and dicts files with
+// matching entries dropped, leaving entries of a different kind sharing
+// the same file (segments and dimensions both live in index) untouched.
+// Unlike flush/compaction, which only ever write into a fresh block
+// directory nothing has read yet, this replaces a file that Get and the
+// data-usage scan may be reading through the shared filecache right
+// now. Every rewrite therefore goes through writeBlockFileAtomic rather
+// than an in-place truncate, and invalidates the path in bs.files
+// afterwards, so concurrent readers see either the old, complete file
+// or the new one, never a torn one, and never a stale cached handle.
+func (bs *blockStore) deleteMatchingInBlock(m *blockMeta, sel Selector) (bytesize.ByteSize, error) {
+	var removed bytesize.ByteSize
+	for _, k := range []kind{kindSegment, kindTree, kindDict} {
+		file := filepath.Join(m.path(), k.blockFile())
+		entries, err := readBlockFile(file)
+		if err != nil {
+			return removed, err
+		}
+		kept := entries[:0]
+		var changed bool
+		for _, e := range entries {
+			tag, rest := untagKey(e.Key)
+			if tag == k && matchesSelector(k, rest, sel) {
+				removed += bytesize.ByteSize(len(e.Key) + len(e.Value))
+				changed = true
+				continue
+			}
+			kept = append(kept, e)
+		}
+		if !changed {
+			continue
+		}
+		sort.Slice(kept, func(i, j int) bool { return string(kept[i].Key) < string(kept[j].Key) })
+		if err = writeBlockFileAtomic(file, kept); err != nil {
+			return removed, err
+		}
+		bs.files.Invalidate(file)
+	}
+	return removed, nil
+}
+
+func matchesSelector(k kind, key []byte, sel Selector) bool {
+	if k == kindDict {
+		// Dicts are not chunked by time, so a MaxAge selector never
+		// matches them.
+		return sel.MaxAge == 0 && sel.matchesApp(appNameFromNormalized(string(key)))
+	}
+	parsed, err := parseTreeKey(string(key))
+	if err != nil {
+		return false
+	}
+	return sel.matchesApp(parsed.AppName) && sel.matchesTime(parsed.Time)
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, sumFileSize(&size))
+	return size, err
+}
+
+func (bs *blockStore) Close() error {
+	bs.mu.Lock()
+	head := bs.head
+	bs.mu.Unlock()
+	if err := bs.flush(head); err != nil {
+		bs.logger.WithError(err).Error("flushing head on close")
+	}
+	bs.files.Close()
+	return bs.wal.Close()
+}
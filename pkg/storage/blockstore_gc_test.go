@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage/filecache"
+)
+
+// treeKeyString builds the same "app{labels}\x00level\x00unixTime"
+// format treeKey produces, without needing a segment.Key, since
+// parseTreeKey only cares about the string shape.
+func treeKeyString(appAndLabels string, level int, t time.Time) string {
+	return appAndLabels + keySep + strconv.Itoa(level) + keySep + strconv.FormatInt(t.Unix(), 10)
+}
+
+func TestDeleteMatchingInBlockRemovesOnlySelectedApp(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	treeEntries := []blockEntry{
+		{Key: taggedKey(kindTree, []byte(treeKeyString("appA{}", 0, now))), Value: []byte("a")},
+		{Key: taggedKey(kindTree, []byte(treeKeyString("appB{}", 0, now))), Value: []byte("b")},
+	}
+	if err := writeBlockFile(dir+"/trees", treeEntries); err != nil {
+		t.Fatalf("writeBlockFile(trees): %v", err)
+	}
+	dictEntries := []blockEntry{
+		{Key: taggedKey(kindDict, []byte("appA{}")), Value: []byte("dictA")},
+		{Key: taggedKey(kindDict, []byte("appB{}")), Value: []byte("dictB")},
+	}
+	if err := writeBlockFile(dir+"/dicts", dictEntries); err != nil {
+		t.Fatalf("writeBlockFile(dicts): %v", err)
+	}
+
+	files, err := filecache.Open(filecache.Config{Dir: dir})
+	if err != nil {
+		t.Fatalf("filecache.Open: %v", err)
+	}
+	defer files.Close()
+
+	m := &blockMeta{dir: dir}
+	bs := &blockStore{files: files}
+	removed, err := bs.deleteMatchingInBlock(m, Selector{AppName: "appA"})
+	if err != nil {
+		t.Fatalf("deleteMatchingInBlock: %v", err)
+	}
+	if removed == 0 {
+		t.Fatal("deleteMatchingInBlock: expected some bytes to be reported removed")
+	}
+
+	gotTrees, err := readBlockFile(dir + "/trees")
+	if err != nil {
+		t.Fatalf("readBlockFile(trees): %v", err)
+	}
+	if len(gotTrees) != 1 {
+		t.Fatalf("trees after gc has %d entries, want 1 (appB's)", len(gotTrees))
+	}
+	_, rest := untagKey(gotTrees[0].Key)
+	parsed, err := parseTreeKey(string(rest))
+	if err != nil || parsed.AppName != "appB" {
+		t.Fatalf("surviving tree entry = %q, want appB's", rest)
+	}
+
+	gotDicts, err := readBlockFile(dir + "/dicts")
+	if err != nil {
+		t.Fatalf("readBlockFile(dicts): %v", err)
+	}
+	if len(gotDicts) != 1 {
+		t.Fatalf("dicts after gc has %d entries, want 1 (appB's)", len(gotDicts))
+	}
+	if _, rest := untagKey(gotDicts[0].Key); string(rest) != "appB{}" {
+		t.Fatalf("surviving dict entry = %q, want appB{}", rest)
+	}
+}
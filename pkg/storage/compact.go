@@ -0,0 +1,292 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage/segment"
+)
+
+// compactionRanges mirrors Prometheus TSDB's exponential range
+// sequence: level N blocks are merged once there are at least two
+// adjacent level N-1 blocks spanning at most compactionRanges[N].
+var compactionRanges = []time.Duration{
+	2 * time.Hour,
+	6 * time.Hour,
+	24 * time.Hour,
+	3 * 24 * time.Hour,
+}
+
+// compactionTask merges adjacent small blocks into larger ones,
+// rewriting tree and dict payloads so that entries older than the
+// retention policy's absolute or per-level age limits are dropped along
+// the way; the policy's size limit is not applied here. It
+// is registered as a regular maintenanceTask so it never runs
+// concurrently with GC, eviction, write-back, or retention.
+func (s *Storage) compactionTask() func() {
+	return func() {
+		if err := s.blocks.compact(s.retentionPolicy()); err != nil {
+			s.logger.WithError(err).Error("compacting blocks")
+		}
+	}
+}
+
+// compact walks compactionRanges from smallest to largest, merging at
+// most one run of plain, same-level blocks per level on each call, where
+// the run together fits within the range of the level it is merged into.
+// Runs left over are merged by later calls.
+func (bs *blockStore) compact(rp *segment.RetentionPolicy) error {
+	for level := 0; level+1 < len(compactionRanges); level++ {
+		group, ok := bs.planCompaction(level, compactionRanges[level+1])
+		if !ok {
+			continue
+		}
+		if err := bs.compactGroup(level+1, group, rp); err != nil {
+			return fmt.Errorf("storage: compact level %d: %w", level+1, err)
+		}
+	}
+	return nil
+}
+
+// planCompaction finds the oldest run of two or more adjacent blocks at
+// the given level that together span at most window.
+func (bs *blockStore) planCompaction(level int, window time.Duration) ([]*blockMeta, bool) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	var run []*blockMeta
+	for _, m := range bs.blocks {
+		if m.Level != level {
+			if len(run) >= 2 {
+				return run, true
+			}
+			run = nil
+			continue
+		}
+		if len(run) == 0 {
+			run = append(run, m)
+			continue
+		}
+		if m.MaxTime.Sub(run[0].MinTime) > window {
+			if len(run) >= 2 {
+				return run, true
+			}
+			run = []*blockMeta{m}
+			continue
+		}
+		run = append(run, m)
+	}
+	if len(run) < 2 {
+		return nil, false
+	}
+	return run, true
+}
+
+// compactGroup merges group into a single new block at the given
+// level, applying rp to every entry it rewrites, then removes the
+// source blocks.
+func (bs *blockStore) compactGroup(level int, group []*blockMeta, rp *segment.RetentionPolicy) error {
+	minTime, maxTime := group[0].MinTime, group[0].MaxTime
+	for _, m := range group[1:] {
+		if m.MinTime.Before(minTime) {
+			minTime = m.MinTime
+		}
+		if m.MaxTime.After(maxTime) {
+			maxTime = m.MaxTime
+		}
+	}
+
+	id := newBlockID(minTime)
+	dir := filepath.Join(bs.storagePath, "blocks", id.String())
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	stats := blockStats{}
+	byFile := make(map[string][]blockEntry)
+
+	trees, liveApps, err := mergeTimeChunkedFiles(group, kindTree, rp)
+	if err != nil {
+		return err
+	}
+	byFile[kindTree.blockFile()] = append(byFile[kindTree.blockFile()], trees...)
+	addKindCount(&stats, kindTree, len(trees))
+
+	segments, _, err := mergeTimeChunkedFiles(group, kindSegment, rp)
+	if err != nil {
+		return err
+	}
+	byFile[kindSegment.blockFile()] = append(byFile[kindSegment.blockFile()], segments...)
+	addKindCount(&stats, kindSegment, len(segments))
+
+	dims, err := mergeBlockFilesByKind(group, kindDimension)
+	if err != nil {
+		return err
+	}
+	byFile[kindDimension.blockFile()] = append(byFile[kindDimension.blockFile()], dims...)
+	addKindCount(&stats, kindDimension, len(dims))
+
+	dicts, err := mergeAndPruneDicts(group, liveApps)
+	if err != nil {
+		return err
+	}
+	byFile[kindDict.blockFile()] = append(byFile[kindDict.blockFile()], dicts...)
+	addKindCount(&stats, kindDict, len(dicts))
+
+	for file, entries := range byFile {
+		sort.Slice(entries, func(i, j int) bool { return string(entries[i].Key) < string(entries[j].Key) })
+		if err := writeBlockFile(filepath.Join(dir, file), entries); err != nil {
+			return err
+		}
+	}
+
+	m := &blockMeta{ULID: id, MinTime: minTime, MaxTime: maxTime, Level: level, Stats: stats, dir: dir}
+	if err := writeMeta(dir, m); err != nil {
+		return err
+	}
+
+	bs.mu.Lock()
+	bs.blocks = replaceGroup(bs.blocks, group, m)
+	bs.mu.Unlock()
+
+	for _, old := range group {
+		if err := os.RemoveAll(old.path()); err != nil {
+			bs.logger.WithError(err).WithField("block", old.ULID.String()).Warn("removing compacted block")
+		}
+	}
+	bs.logger.WithFields(logrus.Fields{
+		"into":  id.String(),
+		"level": level,
+		"from":  len(group),
+	}).Debug("compacted blocks")
+	return nil
+}
+
+// mergeBlockFilesByKind reads and combines the given kind's entries out
+// of every block in group, keeping the most recent value on key
+// collisions (a later block always has a later or equal MinTime).
+func mergeBlockFilesByKind(group []*blockMeta, k kind) (map[string][]byte, error) {
+	merged := make(map[string][]byte)
+	for _, m := range group {
+		entries, err := readBlockFile(filepath.Join(m.path(), k.blockFile()))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			tag, rest := untagKey(e.Key)
+			if tag != k {
+				continue
+			}
+			merged[string(rest)] = e.Value
+		}
+	}
+	return merged, nil
+}
+
+// mergeTimeChunkedFiles merges the trees or segments file of every block
+// in group and drops any entry whose (appName, level, time) key
+// violates rp: either the absolute retention or the level's own MaxAge.
+// This is the compaction-time equivalent of the per-key discard
+// predicate Badger's LSM compaction used to apply before segments,
+// trees, dicts and dimensions moved out of Badger: rewriting the merged
+// block is exactly the point at which that predicate can be evaluated
+// cheaply, without a separate scan-and-delete pass. It also returns the
+// set of segment keys that still have at least one surviving tree, so
+// that mergeAndPruneDicts can drop dictionaries nothing points to
+// anymore.
+func mergeTimeChunkedFiles(group []*blockMeta, k kind, rp *segment.RetentionPolicy) ([]blockEntry, map[string]bool, error) {
+	merged, err := mergeBlockFilesByKind(group, k)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	absoluteCutoff := rp.LowerTimeBoundary()
+	liveApps := make(map[string]bool)
+	out := make([]blockEntry, 0, len(merged))
+	for key, val := range merged {
+		parsed, err := parseTreeKey(key)
+		if err != nil {
+			// Not a time-chunked key we understand; keep it rather than
+			// risk dropping data compaction doesn't know how to parse.
+			out = append(out, blockEntry{Key: taggedKey(k, []byte(key)), Value: val})
+			continue
+		}
+		if expired(parsed, absoluteCutoff, rp.LowerTimeBoundaryForLevel(parsed.Level)) {
+			continue
+		}
+		liveApps[parsed.SegmentKey] = true
+		out = append(out, blockEntry{Key: taggedKey(k, []byte(key)), Value: val})
+	}
+	sort.Slice(out, func(i, j int) bool { return string(out[i].Key) < string(out[j].Key) })
+	return out, liveApps, nil
+}
+
+func expired(key parsedTreeKey, absoluteCutoff, levelCutoff time.Time) bool {
+	if !absoluteCutoff.IsZero() && key.Time.Before(absoluteCutoff) {
+		return true
+	}
+	if !levelCutoff.IsZero() && key.Time.Before(levelCutoff) {
+		return true
+	}
+	return false
+}
+
+// mergeAndPruneDicts merges the dicts file of every block in group,
+// dropping any dictionary whose segment has no surviving tree, the way
+// dicts keyed off a removed dict would otherwise accumulate forever.
+func mergeAndPruneDicts(group []*blockMeta, liveApps map[string]bool) ([]blockEntry, error) {
+	merged, err := mergeBlockFilesByKind(group, kindDict)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]blockEntry, 0, len(merged))
+	for key, val := range merged {
+		if !liveApps[key] {
+			continue
+		}
+		out = append(out, blockEntry{Key: taggedKey(kindDict, []byte(key)), Value: val})
+	}
+	sort.Slice(out, func(i, j int) bool { return string(out[i].Key) < string(out[j].Key) })
+	return out, nil
+}
+
+func addKindCount(stats *blockStats, k kind, n int) {
+	switch k {
+	case kindSegment:
+		stats.NumSegments = n
+	case kindDimension:
+		stats.NumDimensions = n
+	case kindTree:
+		stats.NumTrees = n
+	case kindDict:
+		stats.NumDicts = n
+	}
+}
+
+func replaceGroup(blocks []*blockMeta, group []*blockMeta, replacement *blockMeta) []*blockMeta {
+	remove := make(map[*blockMeta]bool, len(group))
+	for _, m := range group {
+		remove[m] = true
+	}
+	out := make([]*blockMeta, 0, len(blocks)-len(group)+1)
+	inserted := false
+	for _, m := range blocks {
+		if remove[m] {
+			if !inserted {
+				out = append(out, replacement)
+				inserted = true
+			}
+			continue
+		}
+		out = append(out, m)
+	}
+	if !inserted {
+		out = append(out, replacement)
+	}
+	return out
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpired(t *testing.T) {
+	now := time.Unix(1000, 0)
+	key := parsedTreeKey{Time: now}
+
+	if expired(key, time.Time{}, time.Time{}) {
+		t.Fatal("expired: should not expire with no cutoffs set")
+	}
+	if !expired(key, now.Add(time.Second), time.Time{}) {
+		t.Fatal("expired: should expire once the absolute cutoff is after key.Time")
+	}
+	if !expired(key, time.Time{}, now.Add(time.Second)) {
+		t.Fatal("expired: should expire once the level cutoff is after key.Time")
+	}
+	if expired(key, now.Add(-time.Second), now.Add(-time.Second)) {
+		t.Fatal("expired: should not expire when both cutoffs are before key.Time")
+	}
+}
+
+func TestReplaceGroupKeepsOrderAndInsertsAtGroupPosition(t *testing.T) {
+	a := &blockMeta{ULID: newBlockID(time.Unix(1, 0))}
+	b := &blockMeta{ULID: newBlockID(time.Unix(2, 0))}
+	c := &blockMeta{ULID: newBlockID(time.Unix(3, 0))}
+	d := &blockMeta{ULID: newBlockID(time.Unix(4, 0))}
+	replacement := &blockMeta{ULID: newBlockID(time.Unix(5, 0))}
+
+	got := replaceGroup([]*blockMeta{a, b, c, d}, []*blockMeta{b, c}, replacement)
+	want := []*blockMeta{a, replacement, d}
+	if len(got) != len(want) {
+		t.Fatalf("replaceGroup = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("replaceGroup[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestPlanCompactionRequiresAdjacentSameLevelRun(t *testing.T) {
+	bs := &blockStore{
+		blocks: []*blockMeta{
+			{Level: 0, MinTime: time.Unix(0, 0), MaxTime: time.Unix(3600, 0)},
+			{Level: 0, MinTime: time.Unix(3600, 0), MaxTime: time.Unix(7200, 0)},
+			{Level: 1, MinTime: time.Unix(7200, 0), MaxTime: time.Unix(10800, 0)},
+		},
+	}
+
+	group, ok := bs.planCompaction(0, 2*time.Hour)
+	if !ok || len(group) != 2 {
+		t.Fatalf("planCompaction(0, 2h) = %v, %v; want the two adjacent level-0 blocks", group, ok)
+	}
+
+	if _, ok := bs.planCompaction(1, 2*time.Hour); ok {
+		t.Fatal("planCompaction(1, 2h): expected no merge candidate for a single level-1 block")
+	}
+}
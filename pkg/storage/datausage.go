@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pyroscope-io/pyroscope/pkg/util/bytesize"
+)
+
+// treeSizeBuckets are the upper bounds (exclusive) of the tree payload
+// size histogram reported by DataUsageInfo. The last bucket has no
+// upper bound and collects everything >= the previous one.
+var treeSizeBuckets = []bytesize.ByteSize{
+	1 * bytesize.KB,
+	8 * bytesize.KB,
+	64 * bytesize.KB,
+	512 * bytesize.KB,
+	4 * bytesize.MB,
+}
+
+// DataUsageInfo is a point-in-time summary of how storage is spent,
+// broken down by application and retention level, so that operators
+// can see which apps dominate disk usage before tuning RetentionLevels
+// and RetentionSize.
+type DataUsageInfo struct {
+	LastScanTime time.Time `json:"lastScanTime"`
+
+	NumSegments   int `json:"numSegments"`
+	NumDimensions int `json:"numDimensions"`
+	NumTrees      int `json:"numTrees"`
+	NumDicts      int `json:"numDicts"`
+
+	// TreeSizeHistogram buckets tree payload sizes by power-of-two
+	// thresholds: <1KB, <8KB, <64KB, <512KB, <4MB, >=4MB.
+	TreeSizeHistogram []HistogramBucket `json:"treeSizeHistogram"`
+
+	// Apps breaks trees down by application (the __name__ label).
+	Apps map[string]AppDataUsage `json:"apps"`
+
+	// Levels breaks segments down by retention level.
+	Levels map[int]LevelDataUsage `json:"levels"`
+}
+
+// HistogramBucket is a single bucket of a size histogram. UpperBound is
+// the exclusive upper bound of the bucket, or zero for the last,
+// unbounded bucket.
+type HistogramBucket struct {
+	UpperBound bytesize.ByteSize `json:"upperBound"`
+	Count      int               `json:"count"`
+}
+
+// AppDataUsage is a per-application breakdown of tree storage.
+type AppDataUsage struct {
+	NumTrees int               `json:"numTrees"`
+	Bytes    bytesize.ByteSize `json:"bytes"`
+}
+
+// LevelDataUsage is a per-retention-level breakdown of segment counts.
+type LevelDataUsage struct {
+	NumSegments int `json:"numSegments"`
+}
+
+// dataUsageScanInterval is how often the background scan that backs
+// DataUsageInfo runs. The scan walks every block on disk, so it is kept
+// considerably less frequent than the other maintenance tasks.
+const dataUsageScanInterval = 15 * time.Minute
+
+type dataUsageCache struct {
+	mu   sync.RWMutex
+	info DataUsageInfo
+}
+
+// DataUsageInfo returns the most recently scanned data usage summary.
+// The scan itself runs periodically in the background (see
+// dataUsageScanTask) so that admin requests are answered in O(1).
+func (s *Storage) DataUsageInfo() DataUsageInfo {
+	s.dataUsage.mu.RLock()
+	defer s.dataUsage.mu.RUnlock()
+	return s.dataUsage.info
+}
+
+func (s *Storage) dataUsageScanTask() func() {
+	return func() {
+		info := s.scanDataUsage()
+		s.dataUsage.mu.Lock()
+		s.dataUsage.info = info
+		s.dataUsage.mu.Unlock()
+	}
+}
+
+// scanDataUsage walks the head and every on-disk block, computing
+// dataset counts, the tree size histogram, and the per-app and
+// per-level breakdowns.
+func (s *Storage) scanDataUsage() DataUsageInfo {
+	info := DataUsageInfo{
+		LastScanTime: time.Now(),
+		Apps:         make(map[string]AppDataUsage),
+		Levels:       make(map[int]LevelDataUsage),
+	}
+	info.TreeSizeHistogram = make([]HistogramBucket, len(treeSizeBuckets)+1)
+	for i, b := range treeSizeBuckets {
+		info.TreeSizeHistogram[i].UpperBound = b
+	}
+
+	s.blocks.mu.RLock()
+	blocks := append([]*blockMeta(nil), s.blocks.blocks...)
+	head := s.blocks.head
+	s.blocks.mu.RUnlock()
+
+	addTrees := func(entries []blockEntry) {
+		for _, e := range entries {
+			info.NumTrees++
+			info.addTreeSize(bytesize.ByteSize(len(e.Value)))
+			parsed, err := parseTreeKey(string(e.Key))
+			if err != nil {
+				continue
+			}
+			app := info.Apps[parsed.AppName]
+			app.NumTrees++
+			app.Bytes += bytesize.ByteSize(len(e.Value))
+			info.Apps[parsed.AppName] = app
+		}
+	}
+	addSegments := func(entries []blockEntry) {
+		for _, e := range entries {
+			info.NumSegments++
+			parsed, err := parseTreeKey(string(e.Key))
+			if err != nil {
+				continue
+			}
+			lvl := info.Levels[parsed.Level]
+			lvl.NumSegments++
+			info.Levels[parsed.Level] = lvl
+		}
+	}
+
+	addTrees(head.sortedEntries(kindTree))
+	addSegments(filterKind(head.sortedEntries(kindSegment), kindSegment, false))
+	headStats := head.stats()
+	info.NumDicts += headStats.NumDicts
+	info.NumDimensions += headStats.NumDimensions
+
+	for _, m := range blocks {
+		if treeEntries, err := s.blocks.readBlockFile(m.path() + "/trees"); err == nil {
+			addTrees(filterKind(treeEntries, kindTree, true))
+		}
+		if indexEntries, err := s.blocks.readBlockFile(m.path() + "/index"); err == nil {
+			addSegments(filterKind(indexEntries, kindSegment, true))
+		}
+		info.NumDicts += m.Stats.NumDicts
+		info.NumDimensions += m.Stats.NumDimensions
+	}
+
+	return info
+}
+
+// filterKind keeps only the entries tagged with k, stripping the tag
+// byte from their key. When tagged is false the entries came straight
+// out of the Head, which stores keys untagged, so they are returned
+// unmodified.
+func filterKind(entries []blockEntry, k kind, tagged bool) []blockEntry {
+	if !tagged {
+		return entries
+	}
+	out := entries[:0]
+	for _, e := range entries {
+		tag, rest := untagKey(e.Key)
+		if tag != k {
+			continue
+		}
+		out = append(out, blockEntry{Key: rest, Value: e.Value})
+	}
+	return out
+}
+
+func (info *DataUsageInfo) addTreeSize(size bytesize.ByteSize) {
+	for i, b := range treeSizeBuckets {
+		if size < b {
+			info.TreeSizeHistogram[i].Count++
+			return
+		}
+	}
+	info.TreeSizeHistogram[len(treeSizeBuckets)].Count++
+}
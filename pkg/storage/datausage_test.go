@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/pyroscope-io/pyroscope/pkg/util/bytesize"
+)
+
+func TestAddTreeSizeBuckets(t *testing.T) {
+	cases := []struct {
+		size   bytesize.ByteSize
+		bucket int
+	}{
+		{bytesize.ByteSize(512), 0}, // < 1KB
+		{2 * bytesize.KB, 1},        // < 8KB
+		{100 * bytesize.KB, 3},      // < 512KB
+		{10 * bytesize.MB, 5},       // >= 4MB, unbounded bucket
+	}
+
+	for _, c := range cases {
+		info := DataUsageInfo{TreeSizeHistogram: make([]HistogramBucket, len(treeSizeBuckets)+1)}
+		info.addTreeSize(c.size)
+		for i := range info.TreeSizeHistogram {
+			want := 0
+			if i == c.bucket {
+				want = 1
+			}
+			if info.TreeSizeHistogram[i].Count != want {
+				t.Errorf("size %v: bucket %d count = %d, want %d", c.size, i, info.TreeSizeHistogram[i].Count, want)
+			}
+		}
+	}
+}
+
+func TestFilterKind(t *testing.T) {
+	untagged := []blockEntry{{Key: []byte("a")}}
+	if got := filterKind(untagged, kindTree, false); len(got) != 1 {
+		t.Fatalf("untagged passthrough: got %d entries, want 1", len(got))
+	}
+
+	tagged := []blockEntry{
+		{Key: taggedKey(kindTree, []byte("a"))},
+		{Key: taggedKey(kindDict, []byte("b"))},
+	}
+	got := filterKind(tagged, kindTree, true)
+	if len(got) != 1 || string(got[0].Key) != "a" {
+		t.Fatalf("filterKind(kindTree) = %+v, want a single untagged entry \"a\"", got)
+	}
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/dgraph-io/badger/v2"
 	"github.com/dgraph-io/badger/v2/options"
@@ -22,6 +23,13 @@ type db struct {
 
 	lastGC  bytesize.ByteSize
 	gcCount prometheus.Counter
+
+	// discardCutoff, when set, is called before every GC pass to
+	// compute the timestamp below which Badger should drop key
+	// versions during LSM compaction, so that expired data does not
+	// have to wait for a separate scan-and-delete retention pass.
+	discardCutoff      func() time.Time
+	retentionDiscarded prometheus.Counter
 }
 
 type prefix string
@@ -45,6 +53,13 @@ func (p prefix) trim(k []byte) ([]byte, bool) {
 }
 
 func (s *Storage) newBadger(name string, p prefix, codec cache.Codec) (*db, error) {
+	return s.newBadgerWithDiscard(name, p, codec, nil)
+}
+
+// newBadgerWithDiscard is like newBadger, but additionally drives
+// Badger's compaction-time key discard off discardCutoff, called before
+// every GC pass. Pass nil to opt out, as newBadger does.
+func (s *Storage) newBadgerWithDiscard(name string, p prefix, codec cache.Codec, discardCutoff func() time.Time) (*db, error) {
 	badgerPath := filepath.Join(s.config.StoragePath, name)
 	if err := os.MkdirAll(badgerPath, 0o755); err != nil {
 		return nil, err
@@ -68,10 +83,12 @@ func (s *Storage) newBadger(name string, p prefix, codec cache.Codec) (*db, erro
 	}
 
 	d := db{
-		name:    name,
-		DB:      badgerDB,
-		logger:  s.logger.WithField("db", name),
-		gcCount: s.metrics.gcCount.WithLabelValues(name),
+		name:               name,
+		DB:                 badgerDB,
+		logger:             s.logger.WithField("db", name),
+		gcCount:            s.metrics.gcCount.WithLabelValues(name),
+		discardCutoff:      discardCutoff,
+		retentionDiscarded: s.metrics.retentionDiscardedBytes.WithLabelValues(name),
 	}
 
 	if codec != nil {
@@ -113,6 +130,15 @@ func (d *db) size() bytesize.ByteSize {
 
 func (d *db) runGC(discardRatio float64) (reclaimed bool) {
 	d.logger.Debug("starting badger garbage collection")
+	if d.discardCutoff != nil {
+		before := d.size()
+		d.SetDiscardTs(uint64(d.discardCutoff().UnixNano()))
+		defer func() {
+			if after := d.size(); after < before {
+				d.retentionDiscarded.Add(float64(before - after))
+			}
+		}()
+	}
 	// BadgerDB uses 2 compactors by default.
 	if err := d.Flatten(2); err != nil {
 		d.logger.WithError(err).Error("failed to flatten database")
@@ -131,6 +157,20 @@ func (d *db) runGC(discardRatio float64) (reclaimed bool) {
 	}
 }
 
+// flatten runs a full Badger flatten, compacting every level down to
+// one. It is called once when retention configuration changes at
+// runtime, so that the new, possibly much lower, discard cutoff is
+// applied to existing data immediately rather than waiting for the
+// next scheduled GC pass.
+func (d *db) flatten() {
+	if d.discardCutoff != nil {
+		d.SetDiscardTs(uint64(d.discardCutoff().UnixNano()))
+	}
+	if err := d.Flatten(2); err != nil {
+		d.logger.WithError(err).Error("failed to flatten database")
+	}
+}
+
 // TODO(kolesnikovae): filepath.Walk is notoriously slow.
 //  Consider use of https://github.com/karrick/godirwalk.
 //  Although, every badger.DB calculates its size (reported
@@ -0,0 +1,258 @@
+// Package filecache keeps a bounded pool of open *os.File handles for
+// read-heavy, on-disk artifacts — initially the flushed tree and dict
+// block files written by the block storage subsystem (see
+// pkg/storage/block.go), but usable as a generic cache for any
+// directory of immutable files.
+//
+// Multiple Storage instances can point at the same StoragePath (for
+// instance, several gateway processes fronting a shared volume); rather
+// than each of them opening and tidying the same directory
+// independently, a single sharedCache per directory is kept in a
+// package-level registry so file handles and the background tidier are
+// not duplicated.
+package filecache
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// heldopenMax bounds how many file handles a single sharedCache keeps
+// open at once, regardless of how many Cache handles reference it.
+const heldopenMax = 1024
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]*sharedCache)
+)
+
+// sharedCache is the state shared by every Cache opened against the
+// same directory.
+type sharedCache struct {
+	dir string
+
+	refs int // number of Cache handles currently referencing this entry
+
+	mu       sync.Mutex
+	heldopen map[string]*openFileEnt
+
+	tidying int32 // atomic flag: 1 while a tidier goroutine is running
+
+	logger logrus.FieldLogger
+}
+
+// openFileEnt is a refcounted, held-open file handle.
+type openFileEnt struct {
+	mu   sync.Mutex
+	f    *os.File
+	refs int
+
+	// size and atime are bookkeeping for the tidier's LRU-by-size
+	// eviction; they track this handle, not the underlying file, so
+	// evicting an entry only ever closes it and never removes the file
+	// it points to.
+	size  int64
+	atime time.Time
+
+	// invalid is set by Invalidate when the entry still has readers
+	// (refs > 0) at the time of the call, so the actual close can't
+	// happen yet without pulling the file out from under them; release
+	// closes f itself once refs drops to zero.
+	invalid bool
+}
+
+// Config configures a Cache.
+type Config struct {
+	// Dir is the directory the cache serves files out of.
+	Dir string
+	// Max is the size threshold past which the tidier starts closing
+	// the least recently accessed held-open handles, expressed either
+	// as an absolute size or as a percentage of the directory's mount.
+	Max ByteSizeOrPercent
+
+	Logger logrus.FieldLogger
+}
+
+// Cache is a handle onto a sharedCache. Several Cache values can be
+// backed by the same sharedCache if they are opened for the same
+// directory, in which case they share file handles and a single
+// tidier.
+type Cache struct {
+	shared *sharedCache
+	max    ByteSizeOrPercent
+}
+
+// Open returns a Cache for c.Dir, creating the directory's sharedCache
+// if this is the first Cache opened against it, and reusing it
+// otherwise.
+func Open(c Config) (*Cache, error) {
+	if err := os.MkdirAll(c.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	logger := c.Logger
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+
+	registryMu.Lock()
+	sc, ok := registry[c.Dir]
+	if !ok {
+		sc = &sharedCache{
+			dir:      c.Dir,
+			heldopen: make(map[string]*openFileEnt),
+			logger:   logger.WithField("filecache", c.Dir),
+		}
+		registry[c.Dir] = sc
+	}
+	sc.refs++
+	registryMu.Unlock()
+
+	cache := &Cache{shared: sc, max: c.Max}
+	cache.shared.ensureTidier(cache.max)
+	return cache, nil
+}
+
+// Close releases this Cache's reference to its sharedCache. Once the
+// last reference is released, the underlying file handles are closed
+// and the sharedCache is removed from the registry.
+func (c *Cache) Close() {
+	registryMu.Lock()
+	c.shared.refs--
+	closeAll := c.shared.refs <= 0
+	if closeAll {
+		delete(registry, c.shared.dir)
+	}
+	registryMu.Unlock()
+
+	if !closeAll {
+		return
+	}
+	c.shared.mu.Lock()
+	defer c.shared.mu.Unlock()
+	for name, ent := range c.shared.heldopen {
+		ent.f.Close()
+		delete(c.shared.heldopen, name)
+	}
+}
+
+// QuickReadAt reads len(p) bytes from name at off, using a held-open
+// file handle from the pool when one is available, and opening (and
+// caching) a new one otherwise.
+func (c *Cache) QuickReadAt(name string, p []byte, off int64) (int, error) {
+	ent, err := c.shared.open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer c.shared.release(name, ent)
+	ent.mu.Lock()
+	defer ent.mu.Unlock()
+	return ent.f.ReadAt(p, off)
+}
+
+// Invalidate forgets any handle currently held open for name, without
+// touching the file on disk, so that the next QuickReadAt or
+// QuickReadFile reopens it fresh. Callers that replace name's contents
+// out from under the cache (for instance, via a temp-file-and-rename
+// rewrite) must call this afterwards, or reads would keep serving
+// whatever the held-open handle still points at -- the old file's
+// inode, kept alive by the open descriptor even after a rename replaces
+// the directory entry -- forever.
+//
+// If the entry still has readers in flight (refs > 0), the underlying
+// file is left open until release observes refs reaching zero: closing
+// it here regardless of refs could yank the descriptor out from under a
+// goroutine that already has it and is about to read it.
+func (c *Cache) Invalidate(name string) {
+	c.shared.mu.Lock()
+	ent, ok := c.shared.heldopen[name]
+	if !ok {
+		c.shared.mu.Unlock()
+		return
+	}
+	delete(c.shared.heldopen, name)
+	closeNow := ent.refs == 0
+	ent.invalid = true
+	c.shared.mu.Unlock()
+	if closeNow {
+		ent.f.Close()
+	}
+}
+
+// QuickReadFile reads the full contents of name, using a held-open file
+// handle from the pool the same way QuickReadAt does. The size it reads
+// comes from stat'ing that same handle rather than the path, so a
+// rewrite that swaps name's contents out from under the cache (see
+// Invalidate) can never leave this reading a buffer sized for one
+// inode's length against a different inode's bytes.
+func (c *Cache) QuickReadFile(name string) ([]byte, error) {
+	ent, err := c.shared.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer c.shared.release(name, ent)
+	ent.mu.Lock()
+	defer ent.mu.Unlock()
+	info, err := ent.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, info.Size())
+	if _, err := ent.f.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (sc *sharedCache) open(name string) (*openFileEnt, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if ent, ok := sc.heldopen[name]; ok {
+		ent.refs++
+		ent.atime = time.Now()
+		return ent, nil
+	}
+	if len(sc.heldopen) >= heldopenMax {
+		sc.evictOneLocked()
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	ent := &openFileEnt{f: f, refs: 1, size: info.Size(), atime: time.Now()}
+	sc.heldopen[name] = ent
+	return ent, nil
+}
+
+func (sc *sharedCache) release(name string, ent *openFileEnt) {
+	sc.mu.Lock()
+	ent.refs--
+	closeNow := ent.invalid && ent.refs == 0
+	sc.mu.Unlock()
+	if closeNow {
+		ent.f.Close()
+	}
+}
+
+// evictOneLocked closes and forgets an arbitrary unreferenced entry to
+// make room for a new one. It must be called with sc.mu held. The
+// tidier is the one responsible for atime-based eviction by disk usage;
+// this only bounds the number of simultaneously open handles.
+func (sc *sharedCache) evictOneLocked() {
+	for name, ent := range sc.heldopen {
+		if ent.refs > 0 {
+			continue
+		}
+		ent.f.Close()
+		delete(sc.heldopen, name)
+		return
+	}
+}
@@ -0,0 +1,75 @@
+package filecache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInvalidateRereadsAfterRewrite(t *testing.T) {
+	dir := t.TempDir()
+	c, err := Open(Config{Dir: dir})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer c.Close()
+
+	p := filepath.Join(dir, "a")
+	if err := os.WriteFile(p, []byte("old"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	got, err := c.QuickReadFile(p)
+	if err != nil || string(got) != "old" {
+		t.Fatalf("QuickReadFile = %q, %v; want \"old\", nil", got, err)
+	}
+
+	// Rewrite the file the way a temp-file-and-rename GC rewrite would,
+	// then invalidate the stale cached handle QuickReadFile just opened.
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, []byte("new"), 0o644); err != nil {
+		t.Fatalf("WriteFile(tmp): %v", err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	c.Invalidate(p)
+
+	got, err = c.QuickReadFile(p)
+	if err != nil || string(got) != "new" {
+		t.Fatalf("QuickReadFile after Invalidate = %q, %v; want \"new\", nil", got, err)
+	}
+}
+
+// TestInvalidateDoesNotCloseHandleInUse covers the refcount-safety fix:
+// Invalidate must not yank the file descriptor out from under a reader
+// that already holds a reference to the entry, or that reader's
+// in-flight read would fail even though the file on disk is fine. It
+// only defers closing until the held reference is released.
+func TestInvalidateDoesNotCloseHandleInUse(t *testing.T) {
+	dir := t.TempDir()
+	c, err := Open(Config{Dir: dir})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer c.Close()
+
+	p := filepath.Join(dir, "a")
+	if err := os.WriteFile(p, []byte("hello"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	ent, err := c.shared.open(p)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	c.Invalidate(p)
+
+	// ent.refs is still 1 (never released), so Invalidate must have left
+	// the handle open rather than closing it underneath this reference.
+	buf := make([]byte, 5)
+	if _, err := ent.f.ReadAt(buf, 0); err != nil {
+		t.Fatalf("ReadAt on handle held across Invalidate: %v", err)
+	}
+	c.shared.release(p, ent)
+}
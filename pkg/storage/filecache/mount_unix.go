@@ -0,0 +1,14 @@
+//go:build linux || darwin
+
+package filecache
+
+import "syscall"
+
+// mountTotalBytes returns the total capacity of the mount dir lives on.
+func mountTotalBytes(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Blocks) * uint64(stat.Bsize), nil
+}
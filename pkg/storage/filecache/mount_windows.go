@@ -0,0 +1,33 @@
+//go:build windows
+
+package filecache
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32             = syscall.NewLazyDLL("kernel32.dll")
+	procGetDiskFreeSpace = kernel32.NewProc("GetDiskFreeSpaceExW")
+)
+
+// mountTotalBytes returns the total capacity of the volume dir lives
+// on, via GetDiskFreeSpaceExW.
+func mountTotalBytes(dir string) (uint64, error) {
+	path, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var freeBytes, totalBytes, totalFreeBytes uint64
+	r, _, err := procGetDiskFreeSpace.Call(
+		uintptr(unsafe.Pointer(path)),
+		uintptr(unsafe.Pointer(&freeBytes)),
+		uintptr(unsafe.Pointer(&totalBytes)),
+		uintptr(unsafe.Pointer(&totalFreeBytes)),
+	)
+	if r == 0 {
+		return 0, err
+	}
+	return totalBytes, nil
+}
@@ -0,0 +1,61 @@
+package filecache
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pyroscope-io/pyroscope/pkg/util/bytesize"
+)
+
+// ByteSizeOrPercent is a cache size limit expressed either as an
+// absolute number of bytes (e.g. "10GB") or as a percentage of the
+// total capacity of the mount the cached directory lives on (e.g.
+// "80%"). This lets operators cap the cache relative to disk size
+// without having to recompute an absolute value as volumes are resized.
+type ByteSizeOrPercent struct {
+	bytes   bytesize.ByteSize
+	percent float64 // 0 when an absolute size was given
+}
+
+// ParseByteSizeOrPercent parses s as either a bytesize.ByteSize string
+// (e.g. "512MB") or a trailing-percent string (e.g. "80%").
+func ParseByteSizeOrPercent(s string) (ByteSizeOrPercent, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "%") {
+		p, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil {
+			return ByteSizeOrPercent{}, fmt.Errorf("filecache: invalid percent %q: %w", s, err)
+		}
+		if p <= 0 || p > 100 {
+			return ByteSizeOrPercent{}, fmt.Errorf("filecache: percent %q out of range (0, 100]", s)
+		}
+		return ByteSizeOrPercent{percent: p}, nil
+	}
+	var b bytesize.ByteSize
+	if err := b.UnmarshalText([]byte(s)); err != nil {
+		return ByteSizeOrPercent{}, fmt.Errorf("filecache: invalid size %q: %w", s, err)
+	}
+	return ByteSizeOrPercent{bytes: b}, nil
+}
+
+// Resolve returns the limit in absolute bytes for the mount dir lives
+// on, evaluating the percentage (if any) against the mount's total
+// capacity via the per-OS mountTotalBytes.
+func (b ByteSizeOrPercent) Resolve(dir string) (bytesize.ByteSize, error) {
+	if b.percent == 0 {
+		return b.bytes, nil
+	}
+	total, err := mountTotalBytes(dir)
+	if err != nil {
+		return 0, fmt.Errorf("filecache: statfs %s: %w", dir, err)
+	}
+	return bytesize.ByteSize(float64(total) * b.percent / 100), nil
+}
+
+func (b ByteSizeOrPercent) String() string {
+	if b.percent != 0 {
+		return fmt.Sprintf("%g%%", b.percent)
+	}
+	return b.bytes.String()
+}
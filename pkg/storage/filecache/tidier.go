@@ -0,0 +1,85 @@
+package filecache
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/pyroscope-io/pyroscope/pkg/util/bytesize"
+)
+
+// tidyInterval is how often a sharedCache's tidier checks whether its
+// held-open handles are over their size limit.
+const tidyInterval = time.Minute
+
+// ensureTidier starts the background tidier goroutine for sc, unless
+// one is already running. Only one tidier per directory ever runs, even
+// across multiple Cache handles sharing sc. Election uses an atomic
+// flag rather than a plain bool guarded by sc.mu; the tidier itself
+// holds sc.mu for each whole tidy pass, including the sort by atime.
+func (sc *sharedCache) ensureTidier(max ByteSizeOrPercent) {
+	if !atomic.CompareAndSwapInt32(&sc.tidying, 0, 1) {
+		return
+	}
+	go sc.tidyLoop(max)
+}
+
+func (sc *sharedCache) tidyLoop(max ByteSizeOrPercent) {
+	defer atomic.StoreInt32(&sc.tidying, 0)
+	ticker := time.NewTicker(tidyInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		registryMu.Lock()
+		_, stillRegistered := registry[sc.dir]
+		registryMu.Unlock()
+		if !stillRegistered {
+			return
+		}
+		if err := sc.tidy(max); err != nil {
+			sc.logger.WithError(err).Warn("tidying file cache")
+		}
+	}
+}
+
+// tidy closes unreferenced held-open handles in ascending atime order
+// (least recently read first) until the combined size of the handles
+// sc is still holding open no longer exceeds max. It only ever closes
+// file descriptors this cache opened; it never removes files from
+// disk, since sc.dir may be the canonical store for the data it caches
+// rather than a disposable copy of it.
+func (sc *sharedCache) tidy(max ByteSizeOrPercent) error {
+	limit, err := max.Resolve(sc.dir)
+	if err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	entries := make([]*openFileEnt, 0, len(sc.heldopen))
+	names := make(map[*openFileEnt]string, len(sc.heldopen))
+	var total int64
+	for name, ent := range sc.heldopen {
+		entries = append(entries, ent)
+		names[ent] = name
+		total += ent.size
+	}
+
+	if bytesize.ByteSize(total) <= limit {
+		sc.mu.Unlock()
+		return nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].atime.Before(entries[j].atime) })
+	for _, ent := range entries {
+		if bytesize.ByteSize(total) <= limit {
+			break
+		}
+		if ent.refs > 0 {
+			continue
+		}
+		ent.f.Close()
+		delete(sc.heldopen, names[ent])
+		total -= ent.size
+	}
+	sc.mu.Unlock()
+	return nil
+}
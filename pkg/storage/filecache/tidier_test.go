@@ -0,0 +1,56 @@
+package filecache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pyroscope-io/pyroscope/pkg/util/bytesize"
+)
+
+func TestTidyClosesHandlesWithoutDeletingFiles(t *testing.T) {
+	dir := t.TempDir()
+	// A 1-byte limit, well below what two held-open 5-byte files add up
+	// to, forces tidy to evict every unreferenced handle.
+	max := ByteSizeOrPercent{bytes: bytesize.ByteSize(1)}
+	c, err := Open(Config{Dir: dir, Max: max})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer c.Close()
+
+	paths := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b")}
+	for _, p := range paths {
+		if err := os.WriteFile(p, []byte("hello"), 0o644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		buf := make([]byte, 5)
+		if _, err := c.QuickReadAt(p, buf, 0); err != nil {
+			t.Fatalf("QuickReadAt: %v", err)
+		}
+	}
+
+	c.shared.mu.Lock()
+	held := len(c.shared.heldopen)
+	c.shared.mu.Unlock()
+	if held != 2 {
+		t.Fatalf("heldopen has %d entries before tidy, want 2", held)
+	}
+
+	if err := c.shared.tidy(max); err != nil {
+		t.Fatalf("tidy: %v", err)
+	}
+
+	c.shared.mu.Lock()
+	held = len(c.shared.heldopen)
+	c.shared.mu.Unlock()
+	if held != 0 {
+		t.Fatalf("heldopen has %d entries after tidy, want 0", held)
+	}
+
+	for _, p := range paths {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("tidy must never delete cached files from disk, but %s: %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// ulidEntropy is a package-level source for block ID generation. It does
+// not need to be cryptographically strong, only monotonic-ish within a
+// millisecond to keep block directory names distinct.
+var ulidEntropy = ulid.Monotonic(rand.New(rand.NewSource(time.Now().UnixNano())), 0)
+
+// Head is the in-memory index for the current, still-open time window,
+// the way Prometheus TSDB keeps recent samples in a head block before
+// they are persisted. All four datasets that used to live in separate
+// Badger databases (segments, dimensions, trees, dicts) are merged here
+// so that a single flush produces one self-contained block.
+type Head struct {
+	mu sync.RWMutex
+
+	minTime time.Time
+	maxTime time.Time
+
+	segments   map[string][]byte
+	dimensions map[string][]byte
+	trees      map[string][]byte
+	dicts      map[string][]byte
+}
+
+// newHead creates an empty Head covering [start, start+window).
+func newHead(start time.Time, window time.Duration) *Head {
+	return &Head{
+		minTime:    start,
+		maxTime:    start.Add(window),
+		segments:   make(map[string][]byte),
+		dimensions: make(map[string][]byte),
+		trees:      make(map[string][]byte),
+		dicts:      make(map[string][]byte),
+	}
+}
+
+func (h *Head) mapFor(k kind) map[string][]byte {
+	switch k {
+	case kindSegment:
+		return h.segments
+	case kindDimension:
+		return h.dimensions
+	case kindTree:
+		return h.trees
+	case kindDict:
+		return h.dicts
+	default:
+		panic("storage: unknown kind")
+	}
+}
+
+// put stores value under key for the given kind. It does not touch the
+// WAL: callers append the record to the WAL themselves so that the
+// write is durable before it becomes visible, matching the order
+// flush and Replay expect.
+func (h *Head) put(k kind, key string, value []byte) {
+	h.mu.Lock()
+	h.mapFor(k)[key] = value
+	h.mu.Unlock()
+}
+
+func (h *Head) get(k kind, key string) ([]byte, bool) {
+	h.mu.RLock()
+	v, ok := h.mapFor(k)[key]
+	h.mu.RUnlock()
+	return v, ok
+}
+
+// expired reports whether t falls outside the Head's time window and it
+// should be rotated out and flushed.
+func (h *Head) expired(t time.Time) bool {
+	return !t.Before(h.maxTime)
+}
+
+func (h *Head) stats() blockStats {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return blockStats{
+		NumSegments:   len(h.segments),
+		NumDimensions: len(h.dimensions),
+		NumTrees:      len(h.trees),
+		NumDicts:      len(h.dicts),
+	}
+}
+
+// deleteMatching removes every segment, tree and dict entry matching
+// sel, returning how many entries were removed. Dimensions are left
+// alone: a dimension's keys aren't scoped to a single application, so
+// there is nothing in them for a Selector to match against. Dicts are
+// not chunked by time, so they only match a Selector without MaxAge.
+func (h *Head) deleteMatching(sel Selector) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var n int
+	for _, k := range []kind{kindSegment, kindTree} {
+		m := h.mapFor(k)
+		for key := range m {
+			parsed, err := parseTreeKey(key)
+			if err != nil {
+				continue
+			}
+			if sel.matchesApp(parsed.AppName) && sel.matchesTime(parsed.Time) {
+				delete(m, key)
+				n++
+			}
+		}
+	}
+	for key := range h.dicts {
+		if sel.MaxAge == 0 && sel.matchesApp(appNameFromNormalized(key)) {
+			delete(h.dicts, key)
+			n++
+		}
+	}
+	return n
+}
+
+// sortedEntries returns the contents of the given dataset as
+// Key-sorted blockEntry records, ready to be written to a block file.
+func (h *Head) sortedEntries(k kind) []blockEntry {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	m := h.mapFor(k)
+	entries := make([]blockEntry, 0, len(m))
+	for key, val := range m {
+		entries = append(entries, blockEntry{Key: []byte(key), Value: val})
+	}
+	sort.Slice(entries, func(i, j int) bool { return string(entries[i].Key) < string(entries[j].Key) })
+	return entries
+}
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHeadExpiredAndRotation(t *testing.T) {
+	start := time.Unix(0, 0)
+	h := newHead(start, time.Hour)
+
+	if h.expired(start.Add(30 * time.Minute)) {
+		t.Fatal("expired: head should still be open 30m into a 1h window")
+	}
+	if !h.expired(start.Add(time.Hour)) {
+		t.Fatal("expired: head should be expired once the window has fully elapsed")
+	}
+}
+
+func TestHeadPutGetSortedEntries(t *testing.T) {
+	h := newHead(time.Now(), time.Hour)
+	h.put(kindTree, "b", []byte("2"))
+	h.put(kindTree, "a", []byte("1"))
+
+	v, ok := h.get(kindTree, "a")
+	if !ok || string(v) != "1" {
+		t.Fatalf("get(a) = %q, %v; want \"1\", true", v, ok)
+	}
+	if _, ok := h.get(kindTree, "missing"); ok {
+		t.Fatal("get(missing) returned ok=true")
+	}
+
+	entries := h.sortedEntries(kindTree)
+	if len(entries) != 2 || string(entries[0].Key) != "a" || string(entries[1].Key) != "b" {
+		t.Fatalf("sortedEntries = %+v, want [a b] in order", entries)
+	}
+}
+
+// TestHeadStatsRaceWithPut guards the property scanDataUsage relies on:
+// stats() must be safe to call while put() is concurrently mutating the
+// same Head, the way the periodic data-usage scan runs alongside live
+// ingest. It only fails under -race; without the race detector a buggy
+// stats() reading the maps without h.mu would still pass this test.
+func TestHeadStatsRaceWithPut(t *testing.T) {
+	h := newHead(time.Now(), time.Hour)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			h.put(kindDict, "app"+strconv.Itoa(i), []byte("v"))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			h.stats()
+		}
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage/segment"
+)
+
+// keySep separates the fields packed into a tree/segment key. It must
+// not appear in an application name or in segment.Key's normalized
+// label representation.
+const keySep = "\x00"
+
+// treeKey returns the composite key a tree chunk is stored under: the
+// segment it belongs to, together with the retention level and the
+// time of the chunk. Packing level and time into the key lets the
+// data-usage scan (datausage.go) and the retention discard predicate
+// (compact.go) recover them without a secondary index.
+func treeKey(sk *segment.Key, level int, t time.Time) string {
+	return sk.Normalized() + keySep + strconv.Itoa(level) + keySep + strconv.FormatInt(t.Unix(), 10)
+}
+
+// dictKey returns the key a segment's dictionary is stored under. Unlike
+// trees and segments, a dictionary is not chunked by level or time: it
+// is shared by every tree belonging to the same segment.
+func dictKey(sk *segment.Key) string { return sk.Normalized() }
+
+// parsedTreeKey is the result of splitting a key produced by treeKey
+// back into its parts.
+type parsedTreeKey struct {
+	// SegmentKey is the segment's normalized key, e.g. "myapp{foo=bar}".
+	// It doubles as the key the segment's dictionary is stored under.
+	SegmentKey string
+	AppName    string
+	Level      int
+	Time       time.Time
+}
+
+func parseTreeKey(key string) (parsedTreeKey, error) {
+	parts := strings.Split(key, keySep)
+	if len(parts) != 3 {
+		return parsedTreeKey{}, fmt.Errorf("storage: malformed tree key %q", key)
+	}
+	level, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return parsedTreeKey{}, fmt.Errorf("storage: malformed tree key %q: %w", key, err)
+	}
+	unix, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return parsedTreeKey{}, fmt.Errorf("storage: malformed tree key %q: %w", key, err)
+	}
+	return parsedTreeKey{
+		SegmentKey: parts[0],
+		AppName:    appNameFromNormalized(parts[0]),
+		Level:      level,
+		Time:       time.Unix(unix, 0),
+	}, nil
+}
+
+// appNameFromNormalized extracts the application name (the __name__
+// label) from a segment.Key's normalized representation, e.g.
+// "myapp{foo=bar}" -> "myapp".
+func appNameFromNormalized(normalized string) string {
+	if i := strings.IndexByte(normalized, '{'); i >= 0 {
+		return normalized[:i]
+	}
+	return normalized
+}
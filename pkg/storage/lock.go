@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/lock"
+)
+
+// maintenanceLockName identifies this Storage's lease among every node
+// sharing its StoragePath; it is fixed because a single StoragePath
+// only ever has one maintenance workload to coordinate.
+const maintenanceLockName = "maintenance"
+
+// newMaintenanceLocker builds the Locker configured for c, or nil if no
+// driver was configured, which is the common case for a single-node
+// deployment where no coordination is needed.
+func newMaintenanceLocker(c *config.Server) (lock.Locker, error) {
+	switch c.MaintenanceLock.Driver {
+	case "":
+		return nil, nil
+	case "postgres":
+		db, err := sql.Open("postgres", c.MaintenanceLock.DSN)
+		if err != nil {
+			return nil, fmt.Errorf("storage: connect maintenance lock db: %w", err)
+		}
+		// A session advisory lock is bound to the single connection that
+		// took it; holding more than one would let the pool hand the
+		// lock-holding connection to unrelated queries and risk it being
+		// released early.
+		db.SetMaxOpenConns(1)
+		return lock.NewPostgresLocker(db, maintenanceLockName), nil
+	case "redis":
+		client := redis.NewClient(&redis.Options{
+			Addr:     c.MaintenanceLock.Addr,
+			Password: c.MaintenanceLock.Password,
+			DB:       c.MaintenanceLock.DB,
+		})
+		return lock.NewRedisLocker(client, maintenanceLockName, 30*time.Second), nil
+	case "file":
+		return lock.NewFileLocker(filepath.Join(c.StoragePath, "maintenance.lock")), nil
+	default:
+		return nil, fmt.Errorf("storage: unknown maintenance lock driver %q", c.MaintenanceLock.Driver)
+	}
+}
@@ -0,0 +1,54 @@
+package lock
+
+import (
+	"fmt"
+	"os"
+)
+
+// FileLocker is a Locker backed by an exclusive, non-blocking OS file
+// lock, for deployments where every node sharing StoragePath also
+// shares a filesystem (e.g. NFS or a single host) but has no database
+// or Redis available to coordinate through.
+type FileLocker struct {
+	path string
+	f    *os.File
+}
+
+// NewFileLocker returns a FileLocker that locks path, which is created
+// if it does not already exist.
+func NewFileLocker(path string) *FileLocker {
+	return &FileLocker{path: path}
+}
+
+func (l *FileLocker) TryAcquire() (bool, error) {
+	if l.f != nil {
+		// The lock is held for as long as the fd stays open; nothing to
+		// renew.
+		return true, nil
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return false, fmt.Errorf("lock: open %s: %w", l.path, err)
+	}
+	ok, err := tryFlock(f)
+	if err != nil {
+		f.Close()
+		return false, fmt.Errorf("lock: flock %s: %w", l.path, err)
+	}
+	if !ok {
+		f.Close()
+		return false, nil
+	}
+	l.f = f
+	return true, nil
+}
+
+func (l *FileLocker) Release() error {
+	if l.f == nil {
+		return nil
+	}
+	err := unflock(l.f)
+	l.f.Close()
+	l.f = nil
+	return err
+}
@@ -0,0 +1,55 @@
+package lock
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestFileLockerExcludesAnotherHolder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease")
+
+	a := NewFileLocker(path)
+	held, err := a.TryAcquire()
+	if err != nil {
+		t.Fatalf("a.TryAcquire: %v", err)
+	}
+	if !held {
+		t.Fatal("a.TryAcquire: expected the first locker to acquire the lease")
+	}
+
+	b := NewFileLocker(path)
+	held, err = b.TryAcquire()
+	if err != nil {
+		t.Fatalf("b.TryAcquire: %v", err)
+	}
+	if held {
+		t.Fatal("b.TryAcquire: expected a second locker to fail while a holds the lease")
+	}
+
+	if err := a.Release(); err != nil {
+		t.Fatalf("a.Release: %v", err)
+	}
+
+	held, err = b.TryAcquire()
+	if err != nil {
+		t.Fatalf("b.TryAcquire after release: %v", err)
+	}
+	if !held {
+		t.Fatal("b.TryAcquire: expected to acquire the lease once a released it")
+	}
+}
+
+func TestFileLockerTryAcquireRenewsExistingHold(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease")
+	l := NewFileLocker(path)
+
+	for i := 0; i < 3; i++ {
+		held, err := l.TryAcquire()
+		if err != nil {
+			t.Fatalf("TryAcquire #%d: %v", i, err)
+		}
+		if !held {
+			t.Fatalf("TryAcquire #%d: expected the existing holder to keep renewing", i)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+// Package lock provides distributed advisory locks used to coordinate
+// maintenance work (garbage collection, eviction, write-back, retention
+// enforcement) across Storage instances that share the same object
+// storage or volume, so that only one of them performs it at a time.
+package lock
+
+// Locker is a lease-style advisory lock. TryAcquire both acquires a
+// fresh lease and renews one already held by this Locker, so callers
+// can poll it on every maintenance interval rather than managing
+// acquire and renew separately.
+type Locker interface {
+	// TryAcquire attempts to acquire, or if already held, renew the
+	// lease, and reports whether it is held as a result. It must not
+	// block waiting for another holder to give up the lease.
+	TryAcquire() (bool, error)
+	// Release gives up the lease immediately, if held.
+	Release() error
+}
@@ -0,0 +1,57 @@
+package lock
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+)
+
+// PostgresLocker is a Locker backed by a Postgres session-level advisory
+// lock. db must hold a single, long-lived connection (for instance,
+// db.SetMaxOpenConns(1)), since a session advisory lock is bound to the
+// connection that took it, and is released automatically if that
+// connection is dropped.
+type PostgresLocker struct {
+	db  *sql.DB
+	key int64
+
+	held bool
+}
+
+// NewPostgresLocker returns a PostgresLocker that takes the advisory
+// lock keyed by name, hashed to the int64 Postgres's advisory lock
+// functions expect.
+func NewPostgresLocker(db *sql.DB, name string) *PostgresLocker {
+	return &PostgresLocker{db: db, key: advisoryLockKey(name)}
+}
+
+func (l *PostgresLocker) TryAcquire() (bool, error) {
+	if l.held {
+		// Session advisory locks don't expire on their own; as long as
+		// the connection is alive, renewal is a no-op.
+		return true, nil
+	}
+	var ok bool
+	if err := l.db.QueryRow(`select pg_try_advisory_lock($1)`, l.key).Scan(&ok); err != nil {
+		return false, fmt.Errorf("lock: pg_try_advisory_lock: %w", err)
+	}
+	l.held = ok
+	return ok, nil
+}
+
+func (l *PostgresLocker) Release() error {
+	if !l.held {
+		return nil
+	}
+	if _, err := l.db.Exec(`select pg_advisory_unlock($1)`, l.key); err != nil {
+		return fmt.Errorf("lock: pg_advisory_unlock: %w", err)
+	}
+	l.held = false
+	return nil
+}
+
+func advisoryLockKey(name string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	return int64(h.Sum64())
+}
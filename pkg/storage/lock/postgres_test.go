@@ -0,0 +1,12 @@
+package lock
+
+import "testing"
+
+func TestAdvisoryLockKeyIsStableAndDistinct(t *testing.T) {
+	if advisoryLockKey("a") != advisoryLockKey("a") {
+		t.Fatal("advisoryLockKey: expected the same name to hash to the same key")
+	}
+	if advisoryLockKey("a") == advisoryLockKey("b") {
+		t.Fatal("advisoryLockKey: expected different names to hash to different keys")
+	}
+}
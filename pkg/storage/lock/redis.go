@@ -0,0 +1,82 @@
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// renewScript extends the lease's TTL only if it is still held by the
+// token that took it, so a Locker can never renew a lease another node
+// has since acquired after this one's lease expired.
+const renewScript = `
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+else
+	return 0
+end`
+
+// releaseScript deletes the lease only if it is still held by the token
+// that took it, for the same reason.
+const releaseScript = `
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+else
+	return 0
+end`
+
+// RedisLocker is a Locker backed by a Redis key with an expiry, taken
+// and renewed with a per-instance random token so a node can never
+// mistake another node's lease for its own.
+type RedisLocker struct {
+	client *redis.Client
+	key    string
+	token  string
+	ttl    time.Duration
+}
+
+// NewRedisLocker returns a RedisLocker that takes the lease named name
+// on client, held for ttl and renewed on every TryAcquire call. ttl
+// should comfortably exceed the maintenance interval it guards, so a
+// slow renewal doesn't cause the lease to lapse mid-task.
+func NewRedisLocker(client *redis.Client, name string, ttl time.Duration) *RedisLocker {
+	return &RedisLocker{client: client, key: "pyroscope:maintenance-lock:" + name, token: newToken(), ttl: ttl}
+}
+
+func (l *RedisLocker) TryAcquire() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ok, err := l.client.SetNX(ctx, l.key, l.token, l.ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("lock: setnx: %w", err)
+	}
+	if ok {
+		return true, nil
+	}
+
+	renewed, err := l.client.Eval(ctx, renewScript, []string{l.key}, l.token, l.ttl.Milliseconds()).Result()
+	if err != nil {
+		return false, fmt.Errorf("lock: renew: %w", err)
+	}
+	return renewed != int64(0), nil
+}
+
+func (l *RedisLocker) Release() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := l.client.Eval(ctx, releaseScript, []string{l.key}, l.token).Result(); err != nil {
+		return fmt.Errorf("lock: release: %w", err)
+	}
+	return nil
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"strings"
+	"time"
+)
+
+// Selector scopes a CollectGarbageFor call to a subset of stored
+// series, so a targeted gc request doesn't pay for a full sweep. A zero
+// Selector matches everything, which CollectGarbageFor rejects since
+// that is what the regular, unscoped CollectGarbage is for.
+type Selector struct {
+	// AppName restricts matching to series whose application name (the
+	// __name__ label) equals AppName, or, if AppNamePrefix is set,
+	// starts with it.
+	AppName       string
+	AppNamePrefix bool
+
+	// MaxAge, if non-zero, additionally restricts matching to tree
+	// chunks older than MaxAge relative to now.
+	MaxAge time.Duration
+}
+
+func (sel Selector) isZero() bool {
+	return sel.AppName == "" && sel.MaxAge == 0
+}
+
+func (sel Selector) matchesApp(appName string) bool {
+	switch {
+	case sel.AppName == "":
+		return true
+	case sel.AppNamePrefix:
+		return strings.HasPrefix(appName, sel.AppName)
+	default:
+		return appName == sel.AppName
+	}
+}
+
+func (sel Selector) matchesTime(t time.Time) bool {
+	return sel.MaxAge == 0 || time.Since(t) >= sel.MaxAge
+}
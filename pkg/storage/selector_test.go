@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSelectorIsZero(t *testing.T) {
+	if !(Selector{}).isZero() {
+		t.Fatal("isZero: a zero-value Selector must match everything")
+	}
+	if (Selector{AppName: "myapp"}).isZero() {
+		t.Fatal("isZero: a Selector with AppName set must not be zero")
+	}
+	if (Selector{MaxAge: time.Hour}).isZero() {
+		t.Fatal("isZero: a Selector with MaxAge set must not be zero")
+	}
+}
+
+func TestSelectorMatchesApp(t *testing.T) {
+	cases := []struct {
+		sel  Selector
+		name string
+		want bool
+	}{
+		{Selector{}, "anything", true},
+		{Selector{AppName: "myapp"}, "myapp", true},
+		{Selector{AppName: "myapp"}, "otherapp", false},
+		{Selector{AppName: "my", AppNamePrefix: true}, "myapp", true},
+		{Selector{AppName: "my", AppNamePrefix: true}, "otherapp", false},
+	}
+	for _, c := range cases {
+		if got := c.sel.matchesApp(c.name); got != c.want {
+			t.Errorf("%+v.matchesApp(%q) = %v, want %v", c.sel, c.name, got, c.want)
+		}
+	}
+}
+
+func TestSelectorMatchesTime(t *testing.T) {
+	sel := Selector{MaxAge: time.Hour}
+	if sel.matchesTime(time.Now()) {
+		t.Error("matchesTime: a chunk from right now should not match a 1h MaxAge")
+	}
+	if !sel.matchesTime(time.Now().Add(-2 * time.Hour)) {
+		t.Error("matchesTime: a chunk older than MaxAge should match")
+	}
+	if !(Selector{}).matchesTime(time.Now()) {
+		t.Error("matchesTime: a zero MaxAge should match any time")
+	}
+}
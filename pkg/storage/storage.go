@@ -2,8 +2,7 @@ package storage
 
 import (
 	"errors"
-	"os"
-	"path/filepath"
+	"fmt"
 	"runtime"
 	"sync"
 	"time"
@@ -13,6 +12,7 @@ import (
 
 	"github.com/pyroscope-io/pyroscope/pkg/config"
 	"github.com/pyroscope-io/pyroscope/pkg/storage/labels"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/lock"
 	"github.com/pyroscope-io/pyroscope/pkg/storage/segment"
 	"github.com/pyroscope-io/pyroscope/pkg/util/bytesize"
 )
@@ -20,6 +20,11 @@ import (
 var (
 	errRetention = errors.New("could not write because of retention settings")
 	errClosed    = errors.New("storage closed")
+
+	// ErrNotMaintenanceLeader is returned by CollectGarbageFor when a
+	// maintenanceLock is configured and this node does not currently
+	// hold the lease.
+	ErrNotMaintenanceLeader = errors.New("storage: this node does not hold the maintenance lease")
 )
 
 type Storage struct {
@@ -29,12 +34,16 @@ type Storage struct {
 	logger *logrus.Logger
 	*metrics
 
-	segments   *db
-	dimensions *db
-	dicts      *db
-	trees      *db
-	main       *db
-	labels     *labels.Labels
+	// segments, dimensions, trees and dicts no longer live in their own
+	// Badger databases: writes flow through a WAL into a Head, and are
+	// flushed into time-partitioned, immutable blocks once the Head's
+	// window closes. See block.go, head.go and blockstore.go.
+	blocks *blockStore
+
+	main   *db
+	labels *labels.Labels
+
+	dataUsage dataUsageCache
 
 	size bytesize.ByteSize
 
@@ -46,6 +55,13 @@ type Storage struct {
 	stop        chan struct{}
 	wg          sync.WaitGroup
 
+	// maintenanceLock coordinates maintenance tasks across Storage
+	// instances that share a StoragePath (for instance, several
+	// replicas fronting the same object storage or volume), so only the
+	// lease holder runs them. It is nil for a single-node deployment,
+	// where every maintenanceTask simply always runs.
+	maintenanceLock lock.Locker
+
 	putMutex sync.Mutex
 }
 
@@ -58,6 +74,9 @@ type storageOptions struct {
 	gcInterval       time.Duration
 	gcSizeDiff       bytesize.ByteSize
 	reclaimSizeRatio float64
+
+	headRotateInterval time.Duration
+	compactInterval    time.Duration
 }
 
 func New(c *config.Server, logger *logrus.Logger, reg prometheus.Registerer) (*Storage, error) {
@@ -80,6 +99,12 @@ func New(c *config.Server, logger *logrus.Logger, reg prometheus.Registerer) (*S
 			// volume to reclaim is calculated as follows:
 			//   used - limit + limit*ratio.
 			reclaimSizeRatio: 0.05,
+
+			// headRotateInterval bounds how long a Head can stay open for
+			// writes without a new Put triggering its rotation, so that a
+			// quiet server still flushes and frees recovery state.
+			headRotateInterval: time.Minute,
+			compactInterval:    10 * time.Minute,
 		},
 
 		logger:  logger,
@@ -88,19 +113,15 @@ func New(c *config.Server, logger *logrus.Logger, reg prometheus.Registerer) (*S
 	}
 
 	var err error
-	if s.main, err = s.newBadger("main", "", nil); err != nil {
+	if s.maintenanceLock, err = newMaintenanceLocker(c); err != nil {
 		return nil, err
 	}
-	if s.dicts, err = s.newBadger("dicts", dictionaryPrefix, dictionaryCodec{}); err != nil {
+	if s.main, err = s.newBadgerWithDiscard("main", "", nil, func() time.Time {
+		return s.retentionPolicy().LowerTimeBoundary()
+	}); err != nil {
 		return nil, err
 	}
-	if s.dimensions, err = s.newBadger("dimensions", dimensionPrefix, dimensionCodec{}); err != nil {
-		return nil, err
-	}
-	if s.segments, err = s.newBadger("segments", segmentPrefix, segmentCodec{}); err != nil {
-		return nil, err
-	}
-	if s.trees, err = s.newBadger("trees", treePrefix, treeCodec{s}); err != nil {
+	if s.blocks, err = s.newBlockStore(); err != nil {
 		return nil, err
 	}
 
@@ -118,11 +139,25 @@ func New(c *config.Server, logger *logrus.Logger, reg prometheus.Registerer) (*S
 
 	// TODO(kolesnikovae): Make it possible to run CollectGarbage
 	//  without starting any other maintenance tasks at server start.
-	s.wg.Add(4)
+	s.wg.Add(6)
 	go s.maintenanceTask(s.gcInterval, s.watchDBSize(s.gcSizeDiff, s.CollectGarbage))
 	go s.maintenanceTask(s.evictInterval, s.evictionTask(memTotal))
 	go s.maintenanceTask(s.writeBackInterval, s.writeBackTask)
 	go s.periodicTask(s.metricsUpdateInterval, s.updateMetricsTask)
+	go s.periodicTask(s.headRotateInterval, func() {
+		if err := s.blocks.rotateIfExpired(time.Now()); err != nil {
+			s.logger.WithError(err).Error("rotating head")
+		}
+	})
+	go s.maintenanceTask(s.compactInterval, s.compactionTask())
+	s.wg.Add(1)
+	go s.maintenanceTask(dataUsageScanInterval, s.dataUsageScanTask())
+
+	if s.maintenanceLock == nil {
+		// No coordination configured: this is the only node touching
+		// StoragePath, so it is trivially always the maintenance leader.
+		s.setMaintenanceLeader(true)
+	}
 
 	return s, nil
 }
@@ -133,58 +168,52 @@ func (s *Storage) Close() error {
 	s.logger.Debug("waiting for storage tasks to finish")
 	s.wg.Wait()
 	s.logger.Debug("storage tasks to finished")
-	// Dictionaries DB has to close last because trees depend on it.
-	s.goDB(func(d *db) {
-		if d != s.dicts {
-			d.close()
-		}
-	})
-	s.dicts.close()
-	return nil
-}
-
-// goDB runs f for all DBs concurrently.
-func (s *Storage) goDB(f func(*db)) {
-	dbs := s.databases()
-	wg := new(sync.WaitGroup)
-	wg.Add(len(dbs))
-	for _, d := range dbs {
-		go func(db *db) {
-			defer wg.Done()
-			f(db)
-		}(d)
+	s.main.close()
+	if err := s.blocks.Close(); err != nil {
+		s.logger.WithError(err).Error("closing block store")
 	}
-	wg.Wait()
-}
-
-// TODO(kolesnikovae): filepath.Walk is notoriously slow.
-//  Consider use of https://github.com/karrick/godirwalk.
-//  Although, every badger.DB calculates its size (reported
-//  via Size) in the same way every minute.
-func (s *Storage) calculateDBSize(d *db) int64 {
-	var size int64
-	p := filepath.Join(s.config.StoragePath, d.name)
-	_ = filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		switch filepath.Ext(path) {
-		case ".sst", ".vlog":
-			size += info.Size()
+	if s.maintenanceLock != nil {
+		if err := s.maintenanceLock.Release(); err != nil {
+			s.logger.WithError(err).Error("releasing maintenance lease")
 		}
-		return nil
-	})
-	return size
+	}
+	return nil
 }
 
+// maintenanceTask runs f on every interval tick, same as periodicTask,
+// except that when a maintenanceLock is configured, f only runs on the
+// node currently holding the lease: every other node tries to acquire
+// it, fails immediately (TryAcquire never blocks), and skips the tick.
+// This is what lets several Storage instances share a StoragePath
+// without GC, eviction, write-back and retention all competing from
+// every node at once.
 func (s *Storage) maintenanceTask(interval time.Duration, f func()) {
 	s.periodicTask(interval, func() {
+		if s.maintenanceLock != nil {
+			held, err := s.maintenanceLock.TryAcquire()
+			if err != nil {
+				s.logger.WithError(err).Error("acquiring maintenance lease")
+				return
+			}
+			s.setMaintenanceLeader(held)
+			if !held {
+				return
+			}
+		}
 		s.maintenance.Lock()
 		defer s.maintenance.Unlock()
 		f()
 	})
 }
 
+func (s *Storage) setMaintenanceLeader(leader bool) {
+	v := 0.0
+	if leader {
+		v = 1
+	}
+	s.metrics.maintenanceLeader.Set(v)
+}
+
 func (s *Storage) periodicTask(interval time.Duration, f func()) {
 	timer := time.NewTimer(interval)
 	defer func() {
@@ -213,23 +242,13 @@ func (s *Storage) evictionTask(memTotal uint64) func() {
 	return func() {
 		runtime.ReadMemStats(&m)
 		used := float64(m.Alloc) / float64(memTotal)
-		percent := s.config.CacheEvictVolume
 		if used < s.config.CacheEvictThreshold {
 			return
 		}
-		// Dimensions, dictionaries, and segments should not be evicted,
-		// as they are almost 100% in use and will be loaded back, causing
-		// more allocations. Unused items should be unloaded from cache by
-		// TTL expiration. Although, these objects must be written to disk,
-		// order matters.
-		//
-		// It should be noted that in case of a crash or kill, data may become
-		// inconsistent: we should unite databases and do this in a tx.
-		// This is also applied to writeBack task.
-		s.trees.Evict(percent)
-		s.dicts.WriteBack()
-		s.dimensions.WriteBack()
-		s.segments.WriteBack()
+		// Segments, dimensions, trees and dicts no longer hold an
+		// in-process write-back cache: the Head already is the only
+		// copy of hot data kept in memory, and it is bounded by the
+		// head rotation window rather than a memory threshold.
 		// debug.FreeOSMemory()
 		runtime.GC()
 	}
@@ -265,6 +284,69 @@ func (s *Storage) updateMetricsTask() {
 			s.metrics.cacheSize.WithLabelValues(d.name).Set(float64(d.Cache.Size()))
 		}
 	}
+	s.metrics.dbSize.WithLabelValues("blocks").Set(float64(s.blocks.DiskUsage()))
+}
+
+// CollectGarbage enforces the retention policy and reclaims disk space.
+// Block-backed datasets are handled by removing whole expired blocks,
+// which is cheap compared to the old segment-walking eviction pass;
+// finer-grained, per-level enforcement happens as part of compaction.
+// The main database still runs Badger's own value-log GC.
+func (s *Storage) CollectGarbage() {
+	if _, err := s.blocks.enforceRetention(s.retentionPolicy()); err != nil {
+		s.logger.WithError(err).Error("enforcing block retention")
+	}
+	s.main.runGC(0.7)
+}
+
+// CollectGarbageFor runs an ad-hoc, selector-scoped cleanup: unlike
+// CollectGarbage, which runs unconditionally on the regular maintenance
+// schedule, this is for an operator asking to reclaim space for one
+// application right now, via the /admin/gc endpoint or the gc CLI
+// subcommand, so it reports what it removed rather than just logging
+// failures.
+//
+// Like maintenanceTask, it respects maintenanceLock where one is
+// configured: deleteMatchingInBlock rewrites block files in place, so
+// running it from a non-leader node while the leader's own
+// CollectGarbage or compaction pass touches the same blocks would
+// corrupt them.
+func (s *Storage) CollectGarbageFor(sel Selector) (bytesize.ByteSize, error) {
+	if sel.isZero() {
+		return 0, errors.New("storage: empty selector matches everything; use CollectGarbage instead")
+	}
+	if s.maintenanceLock != nil {
+		held, err := s.maintenanceLock.TryAcquire()
+		if err != nil {
+			return 0, fmt.Errorf("storage: acquiring maintenance lease: %w", err)
+		}
+		s.setMaintenanceLeader(held)
+		if !held {
+			return 0, ErrNotMaintenanceLeader
+		}
+	}
+	s.maintenance.Lock()
+	defer s.maintenance.Unlock()
+	removed, err := s.blocks.deleteMatching(sel)
+	if err != nil {
+		return removed, fmt.Errorf("storage: targeted gc: %w", err)
+	}
+	// main no longer holds segment, tree, dict or dimension data, so the
+	// deletions above free nothing in it; it still runs its own
+	// value-log GC here, same as the periodic CollectGarbage path.
+	s.main.runGC(0.5)
+	return removed, nil
+}
+
+// UpdateRetention applies new retention settings and immediately
+// flattens the main database, so obsolete versions do not linger as
+// SST files at L0 until the next scheduled GC pass picks up the new,
+// possibly much lower, discard cutoff.
+func (s *Storage) UpdateRetention(c *config.Server) {
+	s.maintenance.Lock()
+	defer s.maintenance.Unlock()
+	s.config = c
+	s.main.flatten()
 }
 
 func (s *Storage) retentionPolicy() *segment.RetentionPolicy {
@@ -278,14 +360,7 @@ func (s *Storage) retentionPolicy() *segment.RetentionPolicy {
 }
 
 func (s *Storage) databases() []*db {
-	// Order matters.
-	return []*db{
-		s.main,
-		s.dimensions,
-		s.segments,
-		s.dicts,
-		s.trees,
-	}
+	return []*db{s.main}
 }
 
 func (s *Storage) DiskUsage() map[string]bytesize.ByteSize {
@@ -293,6 +368,7 @@ func (s *Storage) DiskUsage() map[string]bytesize.ByteSize {
 	for _, d := range s.databases() {
 		m[d.name] = d.size()
 	}
+	m["blocks"] = s.blocks.DiskUsage()
 	return m
 }
 
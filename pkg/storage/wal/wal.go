@@ -0,0 +1,261 @@
+// Package wal implements a minimal segment-based write-ahead log.
+//
+// Every mutation that lands in the Head is first appended to the WAL so
+// that it can be replayed into a new Head after a crash or restart,
+// before the Head window is flushed into an immutable block. The log is
+// split into size-bounded segment files (similar to Prometheus TSDB) so
+// that old segments can be removed once their data has been persisted
+// into a block, without rewriting the remainder of the log.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// defaultSegmentSize is the maximum size a single WAL segment file is
+// allowed to grow to before a new one is cut.
+const defaultSegmentSize = 128 << 20 // 128MB
+
+// Record is a single WAL entry: a serialized Put operation against the
+// Head index.
+type Record struct {
+	Key   []byte
+	Value []byte
+}
+
+// WAL appends records to a sequence of numbered segment files under dir.
+type WAL struct {
+	mu  sync.Mutex
+	dir string
+
+	cur *os.File
+	w   *bufio.Writer
+	seq int
+	size int64
+
+	segmentSize int64
+}
+
+// Open opens (or creates) the WAL directory and starts writing to the
+// last segment found there, or segment 0 if the directory is empty.
+func Open(dir string) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("wal: create dir: %w", err)
+	}
+	w := &WAL{dir: dir, segmentSize: defaultSegmentSize}
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	seq := 0
+	if len(segments) > 0 {
+		seq = segments[len(segments)-1]
+	}
+	if err = w.openSegment(seq); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func listSegments(dir string) ([]int, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []int
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		n, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		segments = append(segments, n)
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+func (w *WAL) openSegment(seq int) error {
+	f, err := os.OpenFile(filepath.Join(w.dir, segmentName(seq)), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("wal: open segment %d: %w", seq, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.cur = f
+	w.w = bufio.NewWriter(f)
+	w.seq = seq
+	w.size = info.Size()
+	return nil
+}
+
+func segmentName(seq int) string { return fmt.Sprintf("%08d", seq) }
+
+// Log appends a record to the WAL, rotating to a new segment if the
+// current one has grown past segmentSize. The record is fsync'd before
+// Log returns so that it survives a crash.
+func (w *WAL) Log(rec Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.size >= w.segmentSize {
+		if err := w.cutSegment(); err != nil {
+			return err
+		}
+	}
+	buf := encode(rec)
+	n, err := w.w.Write(buf)
+	if err != nil {
+		return fmt.Errorf("wal: write record: %w", err)
+	}
+	w.size += int64(n)
+	if err = w.w.Flush(); err != nil {
+		return err
+	}
+	return w.cur.Sync()
+}
+
+// Cut closes the current segment and starts a new one, regardless of
+// how large the current one has grown. Callers use this to align
+// segment boundaries with Head rotation, so that every record in a
+// segment belongs to a single generation: once that generation is
+// flushed into a block, Truncate can drop the segment(s) before it
+// without touching data the still-open Head needs.
+func (w *WAL) Cut() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.cutSegment()
+}
+
+func (w *WAL) cutSegment() error {
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	if err := w.cur.Close(); err != nil {
+		return err
+	}
+	return w.openSegment(w.seq + 1)
+}
+
+// Truncate removes all segments strictly older than the one currently
+// being written to. It is called once a Head window has been flushed
+// into a block and its WAL segments are no longer needed for recovery;
+// this is only safe to the extent that callers Cut a new segment at
+// every Head rotation, so a segment never holds records from more than
+// one generation.
+func (w *WAL) Truncate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	segments, err := listSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, seq := range segments {
+		if seq >= w.seq {
+			continue
+		}
+		if err = os.Remove(filepath.Join(w.dir, segmentName(seq))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close flushes and closes the current segment file.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	return w.cur.Close()
+}
+
+// Replay reads every record from every segment in dir, in order, and
+// invokes f for each of them. It is used to rebuild a Head on startup.
+func Replay(dir string, f func(Record) error) error {
+	segments, err := listSegments(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, seq := range segments {
+		if err = replaySegment(filepath.Join(dir, segmentName(seq)), f); err != nil {
+			return fmt.Errorf("wal: replay segment %d: %w", seq, err)
+		}
+	}
+	return nil
+}
+
+func replaySegment(path string, f func(Record) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	for {
+		rec, err := decode(r)
+		switch err {
+		case nil:
+			if err = f(rec); err != nil {
+				return err
+			}
+		case io.EOF, io.ErrUnexpectedEOF:
+			// A truncated trailing record indicates a torn write from an
+			// unclean shutdown; stop replaying this segment.
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// encode serializes rec as:
+//   len(key) uint32 | len(value) uint32 | key | value | crc32 uint32
+func encode(rec Record) []byte {
+	buf := make([]byte, 8+len(rec.Key)+len(rec.Value)+4)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(rec.Key)))
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(rec.Value)))
+	off := 8
+	off += copy(buf[off:], rec.Key)
+	off += copy(buf[off:], rec.Value)
+	crc := crc32.ChecksumIEEE(buf[:off])
+	binary.BigEndian.PutUint32(buf[off:], crc)
+	return buf
+}
+
+func decode(r *bufio.Reader) (Record, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return Record{}, err
+	}
+	keyLen := binary.BigEndian.Uint32(hdr[0:4])
+	valLen := binary.BigEndian.Uint32(hdr[4:8])
+	body := make([]byte, keyLen+valLen+4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Record{}, io.ErrUnexpectedEOF
+	}
+	payload := body[:keyLen+valLen]
+	crc := binary.BigEndian.Uint32(body[keyLen+valLen:])
+	if crc32.ChecksumIEEE(append(hdr[:], payload...)) != crc {
+		return Record{}, io.ErrUnexpectedEOF
+	}
+	return Record{Key: payload[:keyLen], Value: payload[keyLen:]}, nil
+}